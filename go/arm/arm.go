@@ -1,10 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -12,27 +16,335 @@ import (
 type SmartContract struct {
 }
 
-// MarketingAuthorization defines a marketing authorization in order to produce a medicine
+// Marketing authorization statuses
+const (
+	AuthorizationSubmitted   = "SUBMITTED"
+	AuthorizationUnderReview = "UNDER_REVIEW"
+	AuthorizationApproved    = "APPROVED"
+	AuthorizationRejected    = "REJECTED"
+	AuthorizationSuspended   = "SUSPENDED"
+	AuthorizationRevoked     = "REVOKED"
+	AuthorizationExpired     = "EXPIRED"
+)
+
+// Chaincode event names. Every transaction that changes an authorization emits exactly
+// one of them, carrying a MarketingAuthorizationEvent as JSON payload
+const (
+	EventAuthorizationSubmitted   = "arm.authorization.submitted"
+	EventAuthorizationUnderReview = "arm.authorization.under_review"
+	EventAuthorizationApproved    = "arm.authorization.approved"
+	EventAuthorizationRejected    = "arm.authorization.rejected"
+	EventAuthorizationSuspended   = "arm.authorization.suspended"
+	EventAuthorizationRevoked     = "arm.authorization.revoked"
+	EventAuthorizationRenewed     = "arm.authorization.renewed"
+	EventAuthorizationReinstated  = "arm.authorization.reinstated"
+	EventAuthorizationExpired     = "arm.authorization.expired"
+)
+
+// authorizationEvents maps each status set by updateAuthorizationStatus to its event
+var authorizationEvents = map[string]string{
+	AuthorizationRejected:  EventAuthorizationRejected,
+	AuthorizationSuspended: EventAuthorizationSuspended,
+	AuthorizationRevoked:   EventAuthorizationRevoked,
+}
+
+// labAuthorizationStatus is the status the lab chaincode keeps for each authorization status
+// pushed to it. Submissions and reviews are not pushed, the lab keeps them as PENDING
+var labAuthorizationStatus = map[string]string{
+	AuthorizationApproved:  "ACTIVE",
+	AuthorizationRejected:  "REJECTED",
+	AuthorizationSuspended: "SUSPENDED",
+	AuthorizationRevoked:   "REVOKED",
+	AuthorizationExpired:   "EXPIRED",
+}
+
+// defaultValidityYears is how long an approval or a renewal lasts when no end date is given
+const defaultValidityYears = 5
+
+// authorizationTransitions lists the statuses an authorization can move to from each status
+var authorizationTransitions = map[string][]string{
+	AuthorizationSubmitted:   {AuthorizationUnderReview, AuthorizationRejected},
+	AuthorizationUnderReview: {AuthorizationApproved, AuthorizationRejected},
+	AuthorizationApproved:    {AuthorizationSuspended, AuthorizationRevoked},
+	AuthorizationSuspended:   {AuthorizationApproved, AuthorizationRevoked},
+}
+
+// MarketingAuthorization defines a marketing authorization in order to produce a medicine.
+// AuthDate, Price and Currency are set when the authorization is approved, later price
+// changes are kept in the price history of the medicine
 type MarketingAuthorization struct {
+	DocType        string               `json:"docType,omitempty"`
+	ARMOwner       string               `json:"armOwner,omitempty"`
+	LaboratoryName string               `json:"laboratoryName"`
+	Medicine       string               `json:"medicine"`
+	CreatedDate    string               `json:"createdDate"`
+	AuthDate       string               `json:"authDate"`
+	Price          string               `json:"price"`
+	Currency       string               `json:"currency"`
+	Status         string               `json:"status"`
+	ValidFrom      string               `json:"validFrom"`
+	ValidUntil     string               `json:"validUntil"`
+	ReviewCycle    int                  `json:"reviewCycle"`
+	History        []AuthorizationEvent `json:"history"`
+}
+
+// AuthorizationEvent records who moved an authorization to a status, when and why.
+// Actor is the invoking client as returned by actor
+type AuthorizationEvent struct {
+	Status string `json:"status"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+	Date   string `json:"date"`
+}
+
+// MarketingAuthorizationEvent is the payload of the authorization chaincode events.
+// Actor, Reason and Date come from the history entry the transaction recorded
+type MarketingAuthorizationEvent struct {
+	ARMOwner       string `json:"armOwner"`
+	LaboratoryName string `json:"laboratoryName"`
+	Medicine       string `json:"medicine"`
+	Status         string `json:"status"`
+	Actor          string `json:"actor"`
+	Reason         string `json:"reason"`
+	Date           string `json:"date"`
+	ValidUntil     string `json:"validUntil,omitempty"`
+}
+
+// isLive tells whether the authorization still blocks a new one for the same medicine
+func (m *MarketingAuthorization) isLive() bool {
+	return m.Status != AuthorizationRejected && m.Status != AuthorizationRevoked && m.Status != AuthorizationExpired
+}
+
+// expire marks an approved or suspended authorization past its validity window as expired.
+// It is worked out whenever the authorization is read, so EXPIRED only reaches the ledger when
+// the authorization is written back after such a read. expireMarketingAuthorization does so and
+// records the expiry in the history, the lab chaincode checks the validity window in the meantime
+func (m *MarketingAuthorization) expire(date string) {
+	if (m.Status == AuthorizationApproved || m.Status == AuthorizationSuspended) && m.ValidUntil != "" && m.ValidUntil <= date {
+		m.Status = AuthorizationExpired
+	}
+}
+
+// validUntil parses the optional end of a validity window, which must come after from.
+// Without one the window lasts defaultValidityYears
+func validUntil(args []string, from string) (string, error) {
+	if len(args) == 0 {
+		t, _ := time.Parse(time.RFC3339, from)
+		return t.AddDate(defaultValidityYears, 0, 0).Format(time.RFC3339), nil
+	}
+
+	until, err := parseDate(args[0])
+	if err != nil {
+		return "", err
+	}
+	if until <= from {
+		return "", fmt.Errorf("Invalid validity end %s. Expecting a date after %s", args[0], from)
+	}
+	return until, nil
+}
+
+// transition moves the authorization to the given status, recording the actor and reason
+func (m *MarketingAuthorization) transition(status string, actor string, reason string, date string) error {
+	current := m.Status
+	if current == "" {
+		// authorizations stored before the approval workflow are still submitted
+		current = AuthorizationSubmitted
+	}
+
+	allowed := false
+	for _, next := range authorizationTransitions[current] {
+		if next == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("Illegal authorization transition: a %s authorization cannot be %s", current, status)
+	}
+
+	m.Status = status
+	m.History = append(m.History, AuthorizationEvent{Status: status, Actor: actor, Reason: reason, Date: date})
+	return nil
+}
+
+// Price change statuses
+const (
+	PriceProposed = "PROPOSED"
+	PriceApproved = "APPROVED"
+	PriceRejected = "REJECTED"
+)
+
+// defaultCurrency is the currency of prices given without one
+const defaultCurrency = "EUR"
+
+var (
+	amountPattern   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	atcPattern      = regexp.MustCompile(`^[A-Z][0-9]{2}[A-Z]{2}[0-9]{2}$`)
+)
+
+// Medicine is the master data of a medicine in the registry. Authorizations and
+// lab orders refer to medicines by their registry Code
+type Medicine struct {
+	DocType          string `json:"docType"`
+	Code             string `json:"code"`
+	Name             string `json:"name"`
+	ActiveIngredient string `json:"activeIngredient"`
+	ATC              string `json:"atc"`
+	Form             string `json:"form"`
+	Strength         string `json:"strength"`
+	PackSize         int    `json:"packSize"`
+}
+
+// Price is an entry of the price history of an authorized medicine. Only approved
+// prices are in force, each one from its EffectiveFrom date until the next one
+type Price struct {
+	DocType        string `json:"docType"`
+	ARMOwner       string `json:"armOwner"`
 	LaboratoryName string `json:"laboratoryName"`
 	Medicine       string `json:"medicine"`
-	CreatedDate    string `json:"createdDate"`
+	Amount         string `json:"amount"`
+	Currency       string `json:"currency"`
+	EffectiveFrom  string `json:"effectiveFrom"`
+	Status         string `json:"status"`
+	ProposedBy     string `json:"proposedBy"`
+	ProposedDate   string `json:"proposedDate"`
+	DecidedBy      string `json:"decidedBy"`
+	DecisionDate   string `json:"decisionDate"`
+	Reason         string `json:"reason"`
+}
+
+// parsePrice validates a price given as a decimal AMOUNT, optionally followed by an ISO 4217
+// CURRENCY code, as in "12.50 EUR". Prices without a currency are in defaultCurrency
+func parsePrice(value string) (string, string, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 1 {
+		fields = append(fields, defaultCurrency)
+	}
+	if len(fields) != 2 || !amountPattern.MatchString(fields[0]) {
+		return "", "", fmt.Errorf("Invalid price %s. Expecting a non negative decimal amount and an optional currency", value)
+	}
+	if !currencyPattern.MatchString(fields[1]) {
+		return "", "", fmt.Errorf("Invalid currency %s. Expecting an ISO 4217 code", fields[1])
+	}
+	return fields[0], fields[1], nil
+}
+
+// Document types of the persisted entities, used by CouchDB rich queries
+const (
+	armDocType           = "arm"
+	laboratoryDocType    = "laboratory"
+	authorizationDocType = "authorization"
+	priceDocType         = "price"
+	medicineDocType      = "medicine"
+	transferDocType      = "transfer"
+	configDocType        = "config"
+)
+
+// Composite key object types. Each entity type has its own namespace, so an
+// ARM, a laboratory and an authorization can never overwrite each other
+const (
+	armIndex           = "arm"           // owner
+	laboratoryIndex    = "laboratory"    // owner, lab
+	authorizationIndex = "authorization" // owner, lab, medicine
+	priceIndex         = "price"         // owner, lab, medicine, effectiveFrom
+	medicineIndex      = "medicine"      // code
+	transferIndex      = "transfer"      // owner, lab
+)
+
+// medicineAuthorizationIndex lists the authorizations of each medicine across ARMs. Its
+// entries hold no value, the authorization is read from its own key
+const medicineAuthorizationIndex = "medicine~authorization" // medicine, owner, lab
+
+// laboratoryOwnerIndex finds the ARMs holding a laboratory without going through every ARM.
+// Like medicineAuthorizationIndex its entries hold no value
+const laboratoryOwnerIndex = "laboratory~owner" // lab, owner
+
+// AuthorizedLaboratory is a laboratory holding an authorization for a medicine. Price and
+// Currency are the ones in force when queried
+type AuthorizedLaboratory struct {
+	LaboratoryName string `json:"laboratoryName"`
+	ARMOwner       string `json:"armOwner"`
+	Status         string `json:"status"`
 	AuthDate       string `json:"authDate"`
 	Price          string `json:"price"`
+	Currency       string `json:"currency"`
+}
+
+// configIndex is the composite key object type of the chaincode configuration
+const configIndex = "config"
+
+// Config defines where the lab chaincode is deployed
+type Config struct {
+	DocType      string `json:"docType"`
+	LabChaincode string `json:"labChaincode"`
+	LabChannel   string `json:"labChannel"`
 }
 
+// defaultConfig is used when the chaincode is instantiated without arguments
+var defaultConfig = Config{LabChaincode: "lab", LabChannel: "mychannel"}
+
+// Laboratory defines a laboratory of an ARM
 type Laboratory struct {
+	DocType        string `json:"docType,omitempty"`
+	ARMOwner       string `json:"armOwner,omitempty"`
+	LaboratoryName string `json:"laboratoryName"`
+}
+
+// LaboratoryTransfer is a laboratory transfer waiting for the owner of the receiving ARM to
+// accept it. An ARM holds at most one pending transfer per laboratory
+type LaboratoryTransfer struct {
+	DocType        string `json:"docType"`
+	ARMOwner       string `json:"armOwner"`
 	LaboratoryName string `json:"laboratoryName"`
+	NewOwner       string `json:"newOwner"`
+	ProposedBy     string `json:"proposedBy"`
+	ProposedDate   string `json:"proposedDate"`
+}
+
+// LaboratoryEntry is a laboratory as listed by queryLabsJSON. Its keys match the summary
+// queryLabsJSON returns in the lab chaincode, which adds the CreatedDate and Address it keeps
+type LaboratoryEntry struct {
+	LaboratoryName string `json:"LaboratoryName"`
+	ARMOwner       string `json:"ARMOwner"`
 }
 
+// Regulators are the clients whose certificate holds the role attribute with the
+// regulator value. They decide on authorizations and prices, and may act for any ARM
+const (
+	roleAttribute = "role"
+	regulatorRole = "regulator"
+)
+
+// ARM defines a marketing authorization holder. Only its master data is stored under
+// the ARM key, laboratories and authorizations are assembled from their own keys on read.
+// MSPID and Subject identify the client that created the ARM, the only one besides the
+// regulators allowed to change it
 type ARM struct {
+	DocType                string                   `json:"docType"`
 	Owner                  string                   `json:"owner"`
 	Desc                   string                   `json:"desc"`
-	Laboratory             []Laboratory             `json:"laboratory"`
-	MarketingAuthorization []MarketingAuthorization `json:"authorizations"`
+	MSPID                  string                   `json:"mspId"`
+	Subject                string                   `json:"subject"`
+	Laboratory             []Laboratory             `json:"laboratory,omitempty"`
+	MarketingAuthorization []MarketingAuthorization `json:"authorizations,omitempty"`
 }
 
+// Init takes the optional {LAB_CHAINCODE, CHANNEL} the authorization statuses are pushed to
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+
+	config := defaultConfig
+	if len(args) == 2 {
+		config = Config{LabChaincode: args[0], LabChannel: args[1]}
+	} else if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 2 {LAB_CHAINCODE, CHANNEL}")
+	}
+
+	if err := putConfig(APIstub, &config); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	fmt.Printf("SmartContract has been instantiated \n")
 	return shim.Success(nil)
 }
@@ -49,12 +361,68 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.addARM(APIstub, args)
 	} else if function == "addLaboratory" {
 		return s.addLaboratory(APIstub, args)
+	} else if function == "removeLaboratory" {
+		return s.removeLaboratory(APIstub, args)
+	} else if function == "transferLaboratory" {
+		return s.transferLaboratory(APIstub, args)
+	} else if function == "acceptLaboratoryTransfer" {
+		return s.acceptLaboratoryTransfer(APIstub, args)
+	} else if function == "cancelLaboratoryTransfer" {
+		return s.cancelLaboratoryTransfer(APIstub, args)
 	} else if function == "queryByMarketingAuthorization" {
 		return s.queryByMarketingAuthorization(APIstub, args)
 	} else if function == "addMarketingAuthorization" {
 		return s.addMarketingAuthorization(APIstub, args)
+	} else if function == "reviewMarketingAuthorization" {
+		return s.reviewMarketingAuthorization(APIstub, args)
+	} else if function == "approveMarketingAuthorization" {
+		return s.approveMarketingAuthorization(APIstub, args)
+	} else if function == "renewMarketingAuthorization" {
+		return s.renewMarketingAuthorization(APIstub, args)
+	} else if function == "reinstateMarketingAuthorization" {
+		return s.reinstateMarketingAuthorization(APIstub, args)
+	} else if function == "expireMarketingAuthorization" {
+		return s.expireMarketingAuthorization(APIstub, args)
+	} else if function == "queryAuthorizationsByMedicine" {
+		return s.queryAuthorizationsByMedicine(APIstub, args)
+	} else if function == "queryExpiringAuthorizations" {
+		return s.queryExpiringAuthorizations(APIstub, args)
+	} else if function == "rejectMarketingAuthorization" {
+		return s.updateAuthorizationStatus(APIstub, args, AuthorizationRejected)
+	} else if function == "suspendMarketingAuthorization" {
+		return s.updateAuthorizationStatus(APIstub, args, AuthorizationSuspended)
+	} else if function == "revokeMarketingAuthorization" {
+		return s.updateAuthorizationStatus(APIstub, args, AuthorizationRevoked)
+	} else if function == "proposePriceChange" {
+		return s.proposePriceChange(APIstub, args)
+	} else if function == "approvePriceChange" {
+		return s.decidePriceChange(APIstub, args, PriceApproved)
+	} else if function == "rejectPriceChange" {
+		return s.decidePriceChange(APIstub, args, PriceRejected)
+	} else if function == "queryPriceHistory" {
+		return s.queryPriceHistory(APIstub, args)
+	} else if function == "queryPriceOnDate" {
+		return s.queryPriceOnDate(APIstub, args)
+	} else if function == "registerMedicine" {
+		return s.registerMedicine(APIstub, args)
+	} else if function == "queryMedicine" {
+		return s.queryMedicine(APIstub, args)
+	} else if function == "queryMedicines" {
+		return s.queryMedicines(APIstub, args)
+	} else if function == "setLabChaincode" {
+		return s.setLabChaincode(APIstub, args)
 	} else if function == "queryLabsJSON" {
 		return s.queryLabsJSON(APIstub, args)
+	} else if function == "queryARMs" {
+		return s.queryARMs(APIstub, args)
+	} else if function == "queryLaboratories" {
+		return s.queryLaboratories(APIstub, args)
+	} else if function == "queryLaboratoryOwners" {
+		return s.queryLaboratoryOwners(APIstub, args)
+	} else if function == "queryAuthorizations" {
+		return s.queryAuthorizations(APIstub, args)
+	} else if function == "migrateARMs" {
+		return s.migrateARMs(APIstub, args)
 	}
 
 	return shim.Error("Invalid Smart Contract function name.")
@@ -67,15 +435,29 @@ func (s *SmartContract) addARM(APIstub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
+	existing, err := getARM(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("ARM %s already exists", args[0]))
+	}
+
+	mspID, subject, err := clientIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	var arm = ARM{
-		Owner:                  args[0],
-		Desc:                   args[1],
-		Laboratory:             nil,
-		MarketingAuthorization: nil,
+		Owner:   args[0],
+		Desc:    args[1],
+		MSPID:   mspID,
+		Subject: subject,
 	}
 
-	armAsBytes, _ := json.Marshal(arm)
-	APIstub.PutState(args[0], armAsBytes)
+	if err := putARM(APIstub, &arm); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
@@ -86,127 +468,1849 @@ func (s *SmartContract) addLaboratory(APIstub shim.ChaincodeStubInterface, args
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
+	if err := checkOwner(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	existing, err := getLaboratory(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s already belongs to ARM %s", args[1], args[0]))
+	}
+
 	var lab = Laboratory{
+		ARMOwner:       args[0],
 		LaboratoryName: args[1],
 	}
 
-	armAsBytes, err := APIstub.GetState(args[0])
+	if err := putLaboratory(APIstub, &lab); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["removeLaboratory", "OWNER1", "BAYER"]}' armcc
+func (s *SmartContract) removeLaboratory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {OWNER, LAB}")
+	}
+
+	if err := checkOwner(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := migrateARM(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lab, err := getLaboratory(APIstub, args[0], args[1])
 	if err != nil {
-		return shim.Error("Failed to get specified ARM")
+		return shim.Error(err.Error())
+	}
+	if lab == nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s does not belong to ARM %s", args[1], args[0]))
 	}
 
-	arm := ARM{}
-	json.Unmarshal(armAsBytes, &arm)
+	// the closed authorizations of the lab and their prices go with it, the live ones keep it in the ARM
+	permissions, err := getAuthorizations(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, permission := range permissions {
+		if permission.isLive() {
+			return shim.Error(fmt.Sprintf("Laboratory %s still holds a %s authorization for %s", args[1], permission.Status, permission.Medicine))
+		}
+	}
 
-	arm.Laboratory = append(arm.Laboratory, lab)
+	prices, err := getPrices(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	armAsBytes, _ = json.Marshal(arm)
-	APIstub.PutState(args[0], armAsBytes)
+	for _, permission := range permissions {
+		if err := deleteAuthorization(APIstub, &permission); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	for _, price := range prices {
+		if err := deletePrice(APIstub, &price); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if err := deleteLaboratory(APIstub, lab); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := deleteTransfer(APIstub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) addMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+// ./executeTransaction.sh '{"Args":["transferLaboratory", "OWNER1", "BAYER", "OWNER2"]}' armcc
+// Offers the lab to another ARM, nothing moves until its owner calls acceptLaboratoryTransfer.
+// Offering it again replaces the pending transfer
+func (s *SmartContract) transferLaboratory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {OWNER, LAB, NEW_OWNER}")
 	}
 
-	var permission = MarketingAuthorization{
-		LaboratoryName: args[1],
-		Medicine:       args[2],
-		CreatedDate:    args[3],
-		AuthDate:       "",
-		Price:          "",
+	if err := checkOwner(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkARM(APIstub, args[2]); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	armAsBytes, err := APIstub.GetState(args[0])
+	lab, err := getLaboratory(APIstub, args[0], args[1])
 	if err != nil {
-		return shim.Error("Failed to get specified ARM")
+		return shim.Error(err.Error())
+	}
+	if lab == nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s does not belong to ARM %s", args[1], args[0]))
 	}
 
-	arm := ARM{}
-	json.Unmarshal(armAsBytes, &arm)
+	existing, err := getLaboratory(APIstub, args[2], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s already belongs to ARM %s", args[1], args[2]))
+	}
 
-	arm.MarketingAuthorization = append(arm.MarketingAuthorization, permission)
+	proposer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	armAsBytes, _ = json.Marshal(arm)
-	APIstub.PutState(args[0], armAsBytes)
+	var transfer = LaboratoryTransfer{
+		ARMOwner:       args[0],
+		LaboratoryName: args[1],
+		NewOwner:       args[2],
+		ProposedBy:     proposer,
+		ProposedDate:   date,
+	}
+	if err := putTransfer(APIstub, &transfer); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-// ./executeQuey.sh '{"Args":["queryByMarketingAuthorization", "OWNER1"]}' armcc
-func (s *SmartContract) queryByMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// ./executeTransaction.sh '{"Args":["acceptLaboratoryTransfer", "OWNER1", "BAYER", "OWNER2"]}' armcc
+// Only the owner of NEW_OWNER may accept. The lab, its authorizations and their prices move in the same
+// transaction, so they are never split between ARMs. The lab chaincode keeps its own copy of the owner,
+// which stays behind until syncARMOwner is called there
+func (s *SmartContract) acceptLaboratoryTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {OWNER, LAB, NEW_OWNER}")
 	}
 
-	if len(args[0]) == 0 {
-		return shim.Error("Empty key. Expecting an ARM")
+	if err := checkOwner(APIstub, args[2]); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	armAsBytes, _ := APIstub.GetState(args[0])
+	transfer, err := getTransfer(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if transfer == nil || transfer.NewOwner != args[2] {
+		return shim.Error(fmt.Sprintf("No transfer of laboratory %s from ARM %s to ARM %s is pending", args[1], args[0], args[2]))
+	}
 
-	if len(armAsBytes) == 0 {
-		return shim.Error("Invalid key. Expecting an ARM")
+	if err := migrateARM(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(armAsBytes)
-}
+	lab, err := getLaboratory(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if lab == nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s does not belong to ARM %s", args[1], args[0]))
+	}
 
-func (s *SmartContract) createLaboratory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	existing, err := getLaboratory(APIstub, args[2], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s already belongs to ARM %s", args[1], args[2]))
+	}
+
+	permissions, err := getAuthorizations(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, permission := range permissions {
+		if err := deleteAuthorization(APIstub, &permission); err != nil {
+			return shim.Error(err.Error())
+		}
+		permission.ARMOwner = args[2]
+		if err := putAuthorization(APIstub, &permission); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	prices, err := getPrices(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, price := range prices {
+		if err := deletePrice(APIstub, &price); err != nil {
+			return shim.Error(err.Error())
+		}
+		price.ARMOwner = args[2]
+		if err := putPrice(APIstub, &price); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if err := deleteLaboratory(APIstub, lab); err != nil {
+		return shim.Error(err.Error())
+	}
+	lab.ARMOwner = args[2]
+	if err := putLaboratory(APIstub, lab); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := deleteTransfer(APIstub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
 
+// ./executeTransaction.sh '{"Args":["cancelLaboratoryTransfer", "OWNER1", "BAYER"]}' armcc
+// Either the owner offering the lab or the one it was offered to may drop the pending transfer
+func (s *SmartContract) cancelLaboratoryTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return shim.Error("Incorrect number of arguments. Expecting 2 {OWNER, LAB}")
 	}
 
-	var lab = Laboratory{
-		LaboratoryName: args[1],
+	transfer, err := getTransfer(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if transfer == nil {
+		return shim.Error(fmt.Sprintf("No transfer of laboratory %s from ARM %s is pending", args[1], args[0]))
+	}
+
+	if err := checkOwner(APIstub, transfer.ARMOwner); err != nil {
+		if err := checkOwner(APIstub, transfer.NewOwner); err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
-	assetAsBytes, _ := json.Marshal(lab)
-	APIstub.PutState(args[0], assetAsBytes)
+	if err := deleteTransfer(APIstub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryLabsJSON(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+// ./executeTransaction.sh '{"Args":["registerMedicine", "IBUPROFENO", "Ibuprofeno 600 mg", "Ibuprofen", "M01AE01", "Film-coated tablet", "600 mg", "40"]}' armcc
+func (s *SmartContract) registerMedicine(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 7 {CODE, NAME, ACTIVE_INGREDIENT, ATC, FORM, STRENGTH, PACK_SIZE}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for i, name := range []string{"CODE", "NAME", "ACTIVE_INGREDIENT", "ATC", "FORM", "STRENGTH"} {
+		if len(args[i]) == 0 {
+			return shim.Error("Empty value. Expecting a " + name)
+		}
+	}
+
+	if !atcPattern.MatchString(args[3]) {
+		return shim.Error(fmt.Sprintf("Invalid ATC code %s. Expecting a chemical substance code such as M01AE01", args[3]))
+	}
+
+	packSize, err := strconv.Atoi(args[6])
+	if err != nil || packSize <= 0 {
+		return shim.Error("Invalid pack size. Expecting a positive integer")
+	}
+
+	existing, err := getMedicine(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error(fmt.Sprintf("Medicine %s is already registered", args[0]))
+	}
+
+	var medicine = Medicine{
+		Code:             args[0],
+		Name:             args[1],
+		ActiveIngredient: args[2],
+		ATC:              args[3],
+		Form:             args[4],
+		Strength:         args[5],
+		PackSize:         packSize,
+	}
 
+	if err := putMedicine(APIstub, &medicine); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeQuery.sh '{"Args":["queryMedicine", "IBUPROFENO"]}' armcc
+func (s *SmartContract) queryMedicine(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return shim.Error("Incorrect number of arguments. Expecting 1 {CODE}")
 	}
 
-	if len(args[0]) == 0 {
-		return shim.Error("Empty key. Expecting an ARM")
+	medicine, err := getMedicine(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if medicine == nil {
+		return shim.Error(fmt.Sprintf("Medicine %s is not registered", args[0]))
 	}
 
-	armAsBytes, _ := APIstub.GetState(args[0])
-	if len(armAsBytes) == 0 {
-		return shim.Error("Invalid key. Expecting a LAB")
+	medicineAsBytes, _ := json.Marshal(medicine)
+	return shim.Success(medicineAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryMedicines"]}' armcc
+func (s *SmartContract) queryMedicines(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	medicines := []Medicine{}
+	err := forEachByPartialKey(APIstub, medicineIndex, args, func(value []byte) error {
+		medicine := Medicine{}
+		if err := json.Unmarshal(value, &medicine); err != nil {
+			return err
+		}
+		medicines = append(medicines, medicine)
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	medicinesAsBytes, _ := json.Marshal(medicines)
+	return shim.Success(medicinesAsBytes)
+}
+
+// ./executeTransaction.sh '{"Args":["addMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "10/10/2018"]}' armcc
+func (s *SmartContract) addMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	if err := checkOwner(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	createdDate, err := parseDate(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	medicine, err := getMedicine(APIstub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if medicine == nil {
+		return shim.Error(fmt.Sprintf("Medicine %s is not registered", args[2]))
 	}
 
-	armStruct := ARM{}
-	json.Unmarshal(armAsBytes, &armStruct)
+	submitter, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var permission = MarketingAuthorization{
+		ARMOwner:       args[0],
+		LaboratoryName: args[1],
+		Medicine:       args[2],
+		CreatedDate:    createdDate,
+		AuthDate:       "",
+		Price:          "",
+		Status:         AuthorizationSubmitted,
+		History:        []AuthorizationEvent{{Status: AuthorizationSubmitted, Actor: submitter, Date: createdDate}},
+	}
+
+	lab, err := getLaboratory(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if lab == nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s does not belong to ARM %s", args[1], args[0]))
+	}
+
+	// a medicine holds one authorization per laboratory until it is rejected, revoked or expired.
+	// A new submission replaces the closed one and carries on its history
+	existing, err := getAuthorization(APIstub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil && existing.isLive() {
+		return shim.Error(fmt.Sprintf("Laboratory %s already holds a %s authorization for %s", args[1], existing.Status, args[2]))
+	}
+	if existing != nil {
+		permission.History = append(existing.History, permission.History...)
+	}
+
+	if err := putAuthorization(APIstub, &permission); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := emitAuthorizationEvent(APIstub, EventAuthorizationSubmitted, &permission); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
 
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+// ./executeTransaction.sh '{"Args":["reviewMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO"]}' armcc
+func (s *SmartContract) reviewMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {OWNER, LAB, MEDICINE}")
+	}
 
-	first := true
-	for _, lab := range armStruct.Laboratory {
-		if first == false {
-			buffer.WriteString(",")
-		} 
-		buffer.WriteString("{")
-		buffer.WriteString("\"LaboratoryName\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(lab.LaboratoryName)
-		buffer.WriteString("\"")
-		buffer.WriteString("}")
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	buffer.WriteString("]")
+	return s.changeAuthorization(APIstub, args[0], args[1], args[2], EventAuthorizationUnderReview, func(permission *MarketingAuthorization, date string) error {
+		return permission.transition(AuthorizationUnderReview, reviewer, "", date)
+	})
+}
+
+// ./executeTransaction.sh '{"Args":["approveMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "12.50 EUR", "Dossier complete", "01/01/2025"]}' armcc
+// VALID_UNTIL is optional, approvals last defaultValidityYears otherwise. The approved PRICE
+// opens the price history of the medicine. Suspended authorizations are reinstated instead
+func (s *SmartContract) approveMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 or 6 {OWNER, LAB, MEDICINE, PRICE, REASON[, VALID_UNTIL]}")
+	}
 
-	return shim.Success(buffer.Bytes())
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	amount, currency, err := parsePrice(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return s.changeAuthorization(APIstub, args[0], args[1], args[2], EventAuthorizationApproved, func(permission *MarketingAuthorization, date string) error {
+		if permission.Status == AuthorizationSuspended {
+			return fmt.Errorf("Illegal authorization approval: a SUSPENDED authorization is lifted with reinstateMarketingAuthorization")
+		}
+
+		until, err := validUntil(args[5:], date)
+		if err != nil {
+			return err
+		}
+		permission.ValidFrom = date
+		permission.ValidUntil = until
+		permission.ReviewCycle = 1
+		if err := permission.transition(AuthorizationApproved, reviewer, args[4], date); err != nil {
+			return err
+		}
+		permission.AuthDate = date
+		permission.Price = amount
+		permission.Currency = currency
+
+		if err := syncLaboratory(APIstub, permission); err != nil {
+			return err
+		}
+		return putPrice(APIstub, &Price{
+			ARMOwner:       args[0],
+			LaboratoryName: args[1],
+			Medicine:       args[2],
+			Amount:         amount,
+			Currency:       currency,
+			EffectiveFrom:  date,
+			Status:         PriceApproved,
+			ProposedBy:     reviewer,
+			ProposedDate:   date,
+			DecidedBy:      reviewer,
+			DecisionDate:   date,
+			Reason:         args[4],
+		})
+	})
+}
+
+// ./executeTransaction.sh '{"Args":["renewMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "Periodic review", "01/01/2030"]}' armcc
+// VALID_UNTIL is optional, a renewal extends the window by defaultValidityYears otherwise
+func (s *SmartContract) renewMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5 {OWNER, LAB, MEDICINE, REASON[, VALID_UNTIL]}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return s.changeAuthorization(APIstub, args[0], args[1], args[2], EventAuthorizationRenewed, func(permission *MarketingAuthorization, date string) error {
+		if permission.Status != AuthorizationApproved {
+			return fmt.Errorf("Illegal authorization renewal: a %s authorization cannot be renewed", permission.Status)
+		}
+
+		until, err := validUntil(args[4:], permission.ValidUntil)
+		if err != nil {
+			return err
+		}
+		permission.ValidUntil = until
+		permission.ReviewCycle++
+		permission.History = append(permission.History, AuthorizationEvent{Status: AuthorizationApproved, Actor: reviewer, Reason: args[3], Date: date})
+		return syncLaboratory(APIstub, permission)
+	})
+}
+
+// ./executeTransaction.sh '{"Args":["reinstateMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "Inspection passed"]}' armcc
+// Lifting a suspension keeps the price, approval date and validity window of the original approval
+func (s *SmartContract) reinstateMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 {OWNER, LAB, MEDICINE, REASON}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args[3]) == 0 {
+		return shim.Error("Empty reason. Expecting why the suspension is lifted")
+	}
+
+	return s.changeAuthorization(APIstub, args[0], args[1], args[2], EventAuthorizationReinstated, func(permission *MarketingAuthorization, date string) error {
+		if permission.Status != AuthorizationSuspended {
+			return fmt.Errorf("Illegal authorization reinstatement: a %s authorization is not suspended", permission.Status)
+		}
+		if err := permission.transition(AuthorizationApproved, reviewer, args[3], date); err != nil {
+			return err
+		}
+		return syncLaboratory(APIstub, permission)
+	})
+}
+
+// ./executeTransaction.sh '{"Args":["expireMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO"]}' armcc
+// Records that an authorization ran past its validity window and pushes the expiry to the lab chaincode
+func (s *SmartContract) expireMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {OWNER, LAB, MEDICINE}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return s.changeAuthorization(APIstub, args[0], args[1], args[2], EventAuthorizationExpired, func(permission *MarketingAuthorization, date string) error {
+		if permission.Status != AuthorizationExpired {
+			return fmt.Errorf("Marketing authorization of %s for %s is %s, it is not past its validity", args[2], args[1], permission.Status)
+		}
+		if n := len(permission.History); n > 0 && permission.History[n-1].Status == AuthorizationExpired {
+			return fmt.Errorf("Expiry of the marketing authorization of %s for %s was already recorded on %s", args[2], args[1], permission.History[n-1].Date)
+		}
+		permission.History = append(permission.History, AuthorizationEvent{Status: AuthorizationExpired, Actor: reviewer, Reason: "Validity ended on " + permission.ValidUntil, Date: date})
+		return syncLaboratory(APIstub, permission)
+	})
+}
+
+// ./executeTransaction.sh '{"Args":["revokeMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "Safety alert"]}' armcc
+// rejectMarketingAuthorization and suspendMarketingAuthorization take the same arguments
+func (s *SmartContract) updateAuthorizationStatus(APIstub shim.ChaincodeStubInterface, args []string, status string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 {OWNER, LAB, MEDICINE, REASON}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args[3]) == 0 {
+		return shim.Error("Empty reason. Expecting why the authorization is " + status)
+	}
+
+	return s.changeAuthorization(APIstub, args[0], args[1], args[2], authorizationEvents[status], func(permission *MarketingAuthorization, date string) error {
+		if err := permission.transition(status, reviewer, args[3], date); err != nil {
+			return err
+		}
+		return syncLaboratory(APIstub, permission)
+	})
+}
+
+// ./executeTransaction.sh '{"Args":["setLabChaincode", "labcc", "mychannel"]}' armcc
+func (s *SmartContract) setLabChaincode(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {LAB_CHAINCODE, CHANNEL}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty name. Expecting a LAB_CHAINCODE")
+	}
+
+	config := Config{LabChaincode: args[0], LabChannel: args[1]}
+	if err := putConfig(APIstub, &config); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// syncLaboratory pushes the status and validity window of an authorization to the lab chaincode,
+// so orders for the medicine follow it. The lab chaincode takes authorizations filed here directly
+// as well, but a lab unknown to it fails the whole transaction
+func syncLaboratory(stub shim.ChaincodeStubInterface, permission *MarketingAuthorization) error {
+	status, ok := labAuthorizationStatus[permission.Status]
+	if !ok {
+		return nil
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+
+	invokeArgs := toChaincodeArgs("setAuthorizationStatus", permission.LaboratoryName, permission.Medicine, status)
+	if permission.ValidUntil != "" {
+		invokeArgs = append(invokeArgs, []byte(permission.ValidUntil))
+	}
+	response := stub.InvokeChaincode(config.LabChaincode, invokeArgs, config.LabChannel)
+	if response.Status != shim.OK {
+		return fmt.Errorf("Failed to invoke labcc. Got error: %s", response.Message)
+	}
+	return nil
+}
+
+// ./executeTransaction.sh '{"Args":["proposePriceChange", "OWNER1", "BAYER", "IBUPROFENO", "13.10 EUR", "01/01/2020"]}' armcc
+func (s *SmartContract) proposePriceChange(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 {OWNER, LAB, MEDICINE, PRICE, EFFECTIVE_FROM}")
+	}
+
+	if err := checkOwner(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	proposer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	amount, currency, err := parsePrice(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	effectiveFrom, err := parseDate(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	permission, err := getAuthorization(APIstub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if permission == nil || (permission.Status != AuthorizationApproved && permission.Status != AuthorizationSuspended) {
+		return shim.Error(fmt.Sprintf("Laboratory %s holds no approved authorization for %s in ARM %s", args[1], args[2], args[0]))
+	}
+
+	// prices already charged cannot be changed afterwards
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if effectiveFrom <= date {
+		return shim.Error(fmt.Sprintf("Invalid effective date %s. Expecting a date after %s", args[4], date))
+	}
+
+	existing, err := getPrice(APIstub, args[0], args[1], args[2], effectiveFrom)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil && existing.Status != PriceRejected {
+		return shim.Error(fmt.Sprintf("A %s price of %s is already effective from %s", existing.Status, args[2], effectiveFrom))
+	}
+
+	var price = Price{
+		ARMOwner:       args[0],
+		LaboratoryName: args[1],
+		Medicine:       args[2],
+		Amount:         amount,
+		Currency:       currency,
+		EffectiveFrom:  effectiveFrom,
+		Status:         PriceProposed,
+		ProposedBy:     proposer,
+		ProposedDate:   date,
+	}
+
+	if err := putPrice(APIstub, &price); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["approvePriceChange", "OWNER1", "BAYER", "IBUPROFENO", "01/01/2020", "Cost study accepted"]}' armcc
+// rejectPriceChange takes the same arguments
+func (s *SmartContract) decidePriceChange(APIstub shim.ChaincodeStubInterface, args []string, status string) sc.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 {OWNER, LAB, MEDICINE, EFFECTIVE_FROM, REASON}")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+	reviewer, err := actor(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	effectiveFrom, err := parseDate(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	price, err := getPrice(APIstub, args[0], args[1], args[2], effectiveFrom)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if price == nil || price.Status != PriceProposed {
+		return shim.Error(fmt.Sprintf("There is no price change of %s proposed from %s", args[2], effectiveFrom))
+	}
+
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if status == PriceApproved && effectiveFrom <= date {
+		return shim.Error(fmt.Sprintf("Price change of %s from %s was not approved in time", args[2], effectiveFrom))
+	}
+
+	// the authorization may have been revoked or expired since the change was proposed
+	if status == PriceApproved {
+		permission, err := getAuthorization(APIstub, args[0], args[1], args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if permission == nil || (permission.Status != AuthorizationApproved && permission.Status != AuthorizationSuspended) {
+			return shim.Error(fmt.Sprintf("Laboratory %s holds no approved authorization for %s in ARM %s", args[1], args[2], args[0]))
+		}
+	}
+
+	price.Status = status
+	price.DecidedBy = reviewer
+	price.DecisionDate = date
+	price.Reason = args[4]
+
+	if err := putPrice(APIstub, price); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeQuery.sh '{"Args":["queryPriceHistory", "OWNER1", "BAYER", "IBUPROFENO"]}' armcc
+func (s *SmartContract) queryPriceHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {OWNER, LAB, MEDICINE}")
+	}
+
+	prices, err := getPrices(APIstub, args...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if prices == nil {
+		prices = []Price{}
+	}
+
+	pricesAsBytes, _ := json.Marshal(prices)
+	return shim.Success(pricesAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryPriceOnDate", "OWNER1", "BAYER", "IBUPROFENO", "15/06/2020"]}' armcc
+func (s *SmartContract) queryPriceOnDate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 {OWNER, LAB, MEDICINE, DATE}")
+	}
+
+	date, err := parseDate(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	inForce, err := priceInForce(APIstub, args[0], args[1], args[2], date)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if inForce == nil {
+		return shim.Error(fmt.Sprintf("There is no approved price of %s on %s", args[2], date))
+	}
+
+	priceAsBytes, _ := json.Marshal(inForce)
+	return shim.Success(priceAsBytes)
+}
+
+// priceInForce returns the approved price of a medicine in force at the given date, if any
+func priceInForce(stub shim.ChaincodeStubInterface, owner string, lab string, medicine string, date string) (*Price, error) {
+	prices, err := getPrices(stub, owner, lab, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	// prices come back sorted by effective date, the last approved one before the date is in force
+	var inForce *Price
+	for i := range prices {
+		if prices[i].EffectiveFrom > date {
+			break
+		}
+		if prices[i].Status == PriceApproved {
+			inForce = &prices[i]
+		}
+	}
+	return inForce, nil
+}
+
+// changeAuthorization applies change to the authorization of a laboratory for a
+// medicine, stamped with the transaction date, stores it back and emits event
+func (s *SmartContract) changeAuthorization(APIstub shim.ChaincodeStubInterface, owner string, lab string, medicine string, event string, change func(*MarketingAuthorization, string) error) sc.Response {
+	permission, err := getAuthorization(APIstub, owner, lab, medicine)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if permission == nil {
+		return shim.Error(fmt.Sprintf("Laboratory %s holds no marketing authorization for %s in ARM %s", lab, medicine, owner))
+	}
+
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := change(permission, date); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := putAuthorization(APIstub, permission); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := emitAuthorizationEvent(APIstub, event, permission); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeQuey.sh '{"Args":["queryByMarketingAuthorization", "OWNER1"]}' armcc
+func (s *SmartContract) queryByMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an ARM")
+	}
+
+	arm, err := getARM(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if arm == nil {
+		return shim.Error("Invalid key. Expecting an ARM")
+	}
+
+	arm.Laboratory, err = getLaboratories(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	arm.MarketingAuthorization, err = getAuthorizations(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	armAsBytes, _ := json.Marshal(arm)
+	return shim.Success(armAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryAuthorizationsByMedicine", "IBUPROFENO"]}' armcc
+func (s *SmartContract) queryAuthorizationsByMedicine(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {MEDICINE}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a MEDICINE")
+	}
+
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(medicineAuthorizationIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	labs := []AuthorizedLaboratory{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		permission, err := getAuthorization(APIstub, attributes[1], attributes[2], attributes[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if permission == nil {
+			continue
+		}
+
+		// the price set on approval stays on the authorization, later changes only reach the history
+		lab := AuthorizedLaboratory{
+			LaboratoryName: permission.LaboratoryName,
+			ARMOwner:       permission.ARMOwner,
+			Status:         permission.Status,
+			AuthDate:       permission.AuthDate,
+			Price:          permission.Price,
+			Currency:       permission.Currency,
+		}
+		inForce, err := priceInForce(APIstub, permission.ARMOwner, permission.LaboratoryName, permission.Medicine, date)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if inForce != nil {
+			lab.Price = inForce.Amount
+			lab.Currency = inForce.Currency
+		}
+		labs = append(labs, lab)
+	}
+
+	labsAsBytes, _ := json.Marshal(labs)
+	return shim.Success(labsAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryExpiringAuthorizations", "OWNER1", "30"]}' armcc
+func (s *SmartContract) queryExpiringAuthorizations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {OWNER, DAYS}")
+	}
+
+	days, err := strconv.Atoi(args[1])
+	if err != nil || days < 0 {
+		return shim.Error(fmt.Sprintf("Invalid number of days %s. Expecting a non negative integer", args[1]))
+	}
+
+	if err := checkARM(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	permissions, err := getAuthorizations(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, _ := time.Parse(time.RFC3339, date)
+	horizon := now.AddDate(0, 0, days).Format(time.RFC3339)
+
+	expiring := []MarketingAuthorization{}
+	for _, permission := range permissions {
+		if (permission.Status == AuthorizationApproved || permission.Status == AuthorizationSuspended) && permission.ValidUntil <= horizon {
+			expiring = append(expiring, permission)
+		}
+	}
+
+	expiringAsBytes, _ := json.Marshal(expiring)
+	return shim.Success(expiringAsBytes)
+}
+
+// ./executeTransaction.sh '{"Args":["createLaboratory", "OWNER1", "BAYER"]}' armcc
+// createLaboratory is kept for existing clients, it is the same as addLaboratory
+func (s *SmartContract) createLaboratory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return s.addLaboratory(APIstub, args)
+}
+
+// ./executeQuery.sh '{"Args":["queryLabsJSON", "OWNER1"]}' armcc
+func (s *SmartContract) queryLabsJSON(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an ARM")
+	}
+
+	if err := checkARM(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	labs, err := getLaboratories(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entries := []LaboratoryEntry{}
+	for _, lab := range labs {
+		entries = append(entries, LaboratoryEntry{LaboratoryName: lab.LaboratoryName, ARMOwner: lab.ARMOwner})
+	}
+
+	entriesAsBytes, _ := json.Marshal(entries)
+	return shim.Success(entriesAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryARMs"]}' armcc
+func (s *SmartContract) queryARMs(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	arms := []ARM{}
+	err := forEachByPartialKey(APIstub, armIndex, args, func(value []byte) error {
+		arm := ARM{}
+		if err := json.Unmarshal(value, &arm); err != nil {
+			return err
+		}
+		arms = append(arms, arm)
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	armsAsBytes, _ := json.Marshal(arms)
+	return shim.Success(armsAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryLaboratories", "OWNER1"]}' armcc
+// Without an OWNER the laboratories of every ARM are listed
+func (s *SmartContract) queryLaboratories(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 1 {OWNER}")
+	}
+
+	labs, err := getLaboratories(APIstub, args...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if labs == nil {
+		labs = []Laboratory{}
+	}
+
+	labsAsBytes, _ := json.Marshal(labs)
+	return shim.Success(labsAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryLaboratoryOwners", "BAYER"]}' armcc
+// Lists the owners of the ARMs holding the laboratory, the lab chaincode expects exactly one.
+// Laboratories of ARMs not yet moved by migrateARMs are not found
+func (s *SmartContract) queryLaboratoryOwners(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {LAB}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(laboratoryOwnerIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	owners := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		owners = append(owners, attributes[1])
+	}
+
+	ownersAsBytes, _ := json.Marshal(owners)
+	return shim.Success(ownersAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryAuthorizations", "OWNER1", "BAYER"]}' armcc
+// OWNER, LAB and MEDICINE narrow the listing down from left to right, all of them are optional
+func (s *SmartContract) queryAuthorizations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 3 {OWNER, LAB, MEDICINE}")
+	}
+
+	permissions, err := getAuthorizations(APIstub, args...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if permissions == nil {
+		permissions = []MarketingAuthorization{}
+	}
+
+	permissionsAsBytes, _ := json.Marshal(permissions)
+	return shim.Success(permissionsAsBytes)
+}
+
+// ./executeTransaction.sh '{"Args":["migrateARMs", "OWNER0", "OWNER999"]}' armcc
+// Moves the ARMs stored under plain keys from START up to END (exclusive), as addARM stored them
+// before the arm namespace, into the namespace. Returns the owners of the moved ARMs
+func (s *SmartContract) migrateARMs(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {START, END}")
+	}
+
+	if len(args[0]) == 0 || len(args[1]) == 0 {
+		return shim.Error("Empty key. Expecting a START and an END")
+	}
+
+	resultsIterator, err := APIstub.GetStateByRange(args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	owners := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		arm, err := getLegacyARM(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if arm == nil {
+			continue
+		}
+		if err := migrateLegacyARM(APIstub, arm); err != nil {
+			return shim.Error(err.Error())
+		}
+		owners = append(owners, arm.Owner)
+	}
+
+	ownersAsBytes, _ := json.Marshal(owners)
+	return shim.Success(ownersAsBytes)
+}
+
+// getConfig reads where the lab chaincode is deployed. Chaincodes instantiated before the
+// configuration existed have none stored and keep pushing to defaultConfig
+func getConfig(stub shim.ChaincodeStubInterface) (*Config, error) {
+	key, err := stub.CreateCompositeKey(configIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	configAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the configuration: %s", err.Error())
+	}
+	if len(configAsBytes) == 0 {
+		config := defaultConfig
+		return &config, nil
+	}
+
+	config := Config{}
+	if err := json.Unmarshal(configAsBytes, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// putConfig stores where the lab chaincode is deployed
+func putConfig(stub shim.ChaincodeStubInterface, config *Config) error {
+	key, err := stub.CreateCompositeKey(configIndex, []string{})
+	if err != nil {
+		return err
+	}
+
+	config.DocType = configDocType
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, configAsBytes)
+}
+
+// toChaincodeArgs converts the function name and arguments of a chaincode invocation
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
+
+// getARM reads the master data of an ARM, nil if it does not exist. An ARM not yet moved
+// by migrateARMs is read from its plain legacy key, along with its embedded lists
+func getARM(stub shim.ChaincodeStubInterface, owner string) (*ARM, error) {
+	key, err := stub.CreateCompositeKey(armIndex, []string{owner})
+	if err != nil {
+		return nil, err
+	}
+
+	armAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get ARM %s: %s", owner, err.Error())
+	}
+	if len(armAsBytes) == 0 {
+		return getLegacyARM(stub, owner)
+	}
+
+	arm := ARM{}
+	if err := json.Unmarshal(armAsBytes, &arm); err != nil {
+		return nil, err
+	}
+	return &arm, nil
+}
+
+// getLegacyARM reads an ARM stored the way addARM did before the arm namespace, under the
+// plain owner key with its laboratories and authorizations embedded, nil if there is none.
+// The bare laboratories the first createLaboratory stored under plain keys are not ARMs
+func getLegacyARM(stub shim.ChaincodeStubInterface, owner string) (*ARM, error) {
+	armAsBytes, err := stub.GetState(owner)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get ARM %s: %s", owner, err.Error())
+	}
+	if len(armAsBytes) == 0 {
+		return nil, nil
+	}
+
+	arm := ARM{}
+	if err := json.Unmarshal(armAsBytes, &arm); err != nil || arm.Owner != owner {
+		return nil, nil
+	}
+	// embedded entries did not repeat their owner
+	for i := range arm.Laboratory {
+		arm.Laboratory[i].ARMOwner = owner
+	}
+	for i := range arm.MarketingAuthorization {
+		arm.MarketingAuthorization[i].ARMOwner = owner
+	}
+	return &arm, nil
+}
+
+// migrateLegacyARM moves a legacy ARM into the arm namespace: its master data, laboratories
+// and authorizations get their own keys and the plain key is removed. Authorizations that
+// were already changed after a legacy read live under their own key and are kept
+func migrateLegacyARM(stub shim.ChaincodeStubInterface, arm *ARM) error {
+	if err := putARM(stub, arm); err != nil {
+		return err
+	}
+	for i := range arm.Laboratory {
+		if err := putLaboratory(stub, &arm.Laboratory[i]); err != nil {
+			return err
+		}
+	}
+	for i := range arm.MarketingAuthorization {
+		permission := &arm.MarketingAuthorization[i]
+		key, err := stub.CreateCompositeKey(authorizationIndex, []string{permission.ARMOwner, permission.LaboratoryName, permission.Medicine})
+		if err != nil {
+			return err
+		}
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return fmt.Errorf("Failed to get authorization for %s: %s", permission.Medicine, err.Error())
+		}
+		if len(existing) != 0 {
+			continue
+		}
+		if err := putAuthorization(stub, permission); err != nil {
+			return err
+		}
+	}
+	return stub.DelState(arm.Owner)
+}
+
+// migrateARM moves the ARM into the arm namespace if it is still a legacy one. Transactions
+// deleting laboratories or authorizations call it first, as deletions only reach the namespace
+func migrateARM(stub shim.ChaincodeStubInterface, owner string) error {
+	key, err := stub.CreateCompositeKey(armIndex, []string{owner})
+	if err != nil {
+		return err
+	}
+	armAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get ARM %s: %s", owner, err.Error())
+	}
+	if len(armAsBytes) != 0 {
+		return nil
+	}
+
+	arm, err := getLegacyARM(stub, owner)
+	if err != nil || arm == nil {
+		return err
+	}
+	return migrateLegacyARM(stub, arm)
+}
+
+// checkARM fails unless the ARM exists
+func checkARM(stub shim.ChaincodeStubInterface, owner string) error {
+	arm, err := getARM(stub, owner)
+	if err != nil {
+		return err
+	}
+	if arm == nil {
+		return fmt.Errorf("ARM %s does not exist", owner)
+	}
+	return nil
+}
+
+// checkOwner fails unless the ARM exists and the invoking client created it or is a regulator
+func checkOwner(stub shim.ChaincodeStubInterface, owner string) error {
+	arm, err := getARM(stub, owner)
+	if err != nil {
+		return err
+	}
+	if arm == nil {
+		return fmt.Errorf("ARM %s does not exist", owner)
+	}
+
+	regulator, err := isRegulator(stub)
+	if err != nil || regulator {
+		return err
+	}
+
+	mspID, subject, err := clientIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if arm.MSPID == "" || mspID != arm.MSPID || subject != arm.Subject {
+		return fmt.Errorf("Permission denied: %s of %s does not own ARM %s", subject, mspID, owner)
+	}
+	return nil
+}
+
+// checkRegulator fails unless the invoking client is a regulator
+func checkRegulator(stub shim.ChaincodeStubInterface) error {
+	regulator, err := isRegulator(stub)
+	if err != nil {
+		return err
+	}
+	if !regulator {
+		return fmt.Errorf("Permission denied: only a regulator may do this")
+	}
+	return nil
+}
+
+// isRegulator tells whether the certificate of the invoking client holds the regulator role
+func isRegulator(stub shim.ChaincodeStubInterface) (bool, error) {
+	role, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get client identity: %s", err.Error())
+	}
+	return found && role == regulatorRole, nil
+}
+
+// clientIdentity returns the MSP ID and the certificate subject of the invoking client
+func clientIdentity(stub shim.ChaincodeStubInterface) (string, string, error) {
+	client, err := cid.New(stub)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get client identity: %s", err.Error())
+	}
+
+	mspID, err := client.GetMSPID()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get client identity: %s", err.Error())
+	}
+	cert, err := client.GetX509Certificate()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get client identity: %s", err.Error())
+	}
+	return mspID, cert.Subject.String(), nil
+}
+
+// actor names the invoking client in authorization and price histories as MSPID/subject,
+// so nobody can record a decision in someone else's name
+func actor(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, subject, err := clientIdentity(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + subject, nil
+}
+
+// putARM stores the master data of an ARM under arm~owner
+func putARM(stub shim.ChaincodeStubInterface, arm *ARM) error {
+	key, err := stub.CreateCompositeKey(armIndex, []string{arm.Owner})
+	if err != nil {
+		return err
+	}
+
+	master := ARM{DocType: armDocType, Owner: arm.Owner, Desc: arm.Desc, MSPID: arm.MSPID, Subject: arm.Subject}
+	armAsBytes, _ := json.Marshal(master)
+	return stub.PutState(key, armAsBytes)
+}
+
+// getLaboratory reads a laboratory of an ARM, nil if it does not belong to it. Laboratories
+// of a legacy ARM are looked up in it
+func getLaboratory(stub shim.ChaincodeStubInterface, owner string, lab string) (*Laboratory, error) {
+	key, err := stub.CreateCompositeKey(laboratoryIndex, []string{owner, lab})
+	if err != nil {
+		return nil, err
+	}
+
+	labAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get laboratory %s: %s", lab, err.Error())
+	}
+	if len(labAsBytes) == 0 {
+		legacy, err := getLegacyARM(stub, owner)
+		if err != nil || legacy == nil {
+			return nil, err
+		}
+		for i := range legacy.Laboratory {
+			if legacy.Laboratory[i].LaboratoryName == lab {
+				return &legacy.Laboratory[i], nil
+			}
+		}
+		return nil, nil
+	}
+
+	laboratory := Laboratory{}
+	if err := json.Unmarshal(labAsBytes, &laboratory); err != nil {
+		return nil, err
+	}
+	return &laboratory, nil
+}
+
+// getLaboratories lists the laboratories whose key starts with the given owner. Given an owner,
+// the laboratories embedded in its legacy ARM are listed too, without one only migrated ARMs are
+func getLaboratories(stub shim.ChaincodeStubInterface, attributes ...string) ([]Laboratory, error) {
+	var labs []Laboratory
+	err := forEachByPartialKey(stub, laboratoryIndex, attributes, func(value []byte) error {
+		lab := Laboratory{}
+		if err := json.Unmarshal(value, &lab); err != nil {
+			return err
+		}
+		labs = append(labs, lab)
+		return nil
+	})
+	if err != nil || len(attributes) == 0 {
+		return labs, err
+	}
+
+	legacy, err := getLegacyARM(stub, attributes[0])
+	if err != nil || legacy == nil {
+		return labs, err
+	}
+	for _, lab := range legacy.Laboratory {
+		listed := false
+		for _, other := range labs {
+			listed = listed || other.LaboratoryName == lab.LaboratoryName
+		}
+		if !listed {
+			labs = append(labs, lab)
+		}
+	}
+	return labs, nil
+}
+
+// putLaboratory stores a laboratory under laboratory~owner~lab
+func putLaboratory(stub shim.ChaincodeStubInterface, lab *Laboratory) error {
+	key, err := stub.CreateCompositeKey(laboratoryIndex, []string{lab.ARMOwner, lab.LaboratoryName})
+	if err != nil {
+		return err
+	}
+	indexKey, err := stub.CreateCompositeKey(laboratoryOwnerIndex, []string{lab.LaboratoryName, lab.ARMOwner})
+	if err != nil {
+		return err
+	}
+
+	lab.DocType = laboratoryDocType
+	labAsBytes, _ := json.Marshal(lab)
+	if err := stub.PutState(key, labAsBytes); err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+// deleteLaboratory removes a laboratory from its ARM
+func deleteLaboratory(stub shim.ChaincodeStubInterface, lab *Laboratory) error {
+	key, err := stub.CreateCompositeKey(laboratoryIndex, []string{lab.ARMOwner, lab.LaboratoryName})
+	if err != nil {
+		return err
+	}
+	indexKey, err := stub.CreateCompositeKey(laboratoryOwnerIndex, []string{lab.LaboratoryName, lab.ARMOwner})
+	if err != nil {
+		return err
+	}
+
+	if err := stub.DelState(key); err != nil {
+		return err
+	}
+	return stub.DelState(indexKey)
+}
+
+// getAuthorization reads the authorization of a laboratory for a medicine, nil if there is none.
+// Authorizations of a legacy ARM are looked up in it. Past-due authorizations come back expired
+func getAuthorization(stub shim.ChaincodeStubInterface, owner string, lab string, medicine string) (*MarketingAuthorization, error) {
+	key, err := stub.CreateCompositeKey(authorizationIndex, []string{owner, lab, medicine})
+	if err != nil {
+		return nil, err
+	}
+
+	permissionAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get authorization for %s: %s", medicine, err.Error())
+	}
+
+	permission := MarketingAuthorization{}
+	if len(permissionAsBytes) != 0 {
+		if err := json.Unmarshal(permissionAsBytes, &permission); err != nil {
+			return nil, err
+		}
+	} else {
+		legacy, err := getLegacyARM(stub, owner)
+		if err != nil || legacy == nil {
+			return nil, err
+		}
+		found := false
+		for _, embedded := range legacy.MarketingAuthorization {
+			if embedded.LaboratoryName == lab && embedded.Medicine == medicine {
+				permission = embedded
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+
+	date, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	permission.expire(date)
+	return &permission, nil
+}
+
+// getAuthorizations lists the authorizations whose key starts with the given owner, lab and
+// medicine. Given an owner, those embedded in its legacy ARM and not changed since are listed
+// too, without one only migrated ARMs are. Past-due authorizations come back expired
+func getAuthorizations(stub shim.ChaincodeStubInterface, attributes ...string) ([]MarketingAuthorization, error) {
+	date, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []MarketingAuthorization
+	err = forEachByPartialKey(stub, authorizationIndex, attributes, func(value []byte) error {
+		permission := MarketingAuthorization{}
+		if err := json.Unmarshal(value, &permission); err != nil {
+			return err
+		}
+		permission.expire(date)
+		permissions = append(permissions, permission)
+		return nil
+	})
+	if err != nil || len(attributes) == 0 {
+		return permissions, err
+	}
+
+	legacy, err := getLegacyARM(stub, attributes[0])
+	if err != nil || legacy == nil {
+		return permissions, err
+	}
+	for _, permission := range legacy.MarketingAuthorization {
+		if (len(attributes) > 1 && permission.LaboratoryName != attributes[1]) || (len(attributes) > 2 && permission.Medicine != attributes[2]) {
+			continue
+		}
+		listed := false
+		for _, other := range permissions {
+			listed = listed || (other.LaboratoryName == permission.LaboratoryName && other.Medicine == permission.Medicine)
+		}
+		if !listed {
+			permission.expire(date)
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions, nil
+}
+
+// putAuthorization stores an authorization under authorization~owner~lab~medicine,
+// keeping its entry in the medicine~authorization index
+func putAuthorization(stub shim.ChaincodeStubInterface, permission *MarketingAuthorization) error {
+	key, err := stub.CreateCompositeKey(authorizationIndex, []string{permission.ARMOwner, permission.LaboratoryName, permission.Medicine})
+	if err != nil {
+		return err
+	}
+	indexKey, err := stub.CreateCompositeKey(medicineAuthorizationIndex, []string{permission.Medicine, permission.ARMOwner, permission.LaboratoryName})
+	if err != nil {
+		return err
+	}
+
+	permission.DocType = authorizationDocType
+	permissionAsBytes, _ := json.Marshal(permission)
+	if err := stub.PutState(key, permissionAsBytes); err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+// deleteAuthorization removes an authorization from its ARM and from the medicine~authorization index
+func deleteAuthorization(stub shim.ChaincodeStubInterface, permission *MarketingAuthorization) error {
+	key, err := stub.CreateCompositeKey(authorizationIndex, []string{permission.ARMOwner, permission.LaboratoryName, permission.Medicine})
+	if err != nil {
+		return err
+	}
+	indexKey, err := stub.CreateCompositeKey(medicineAuthorizationIndex, []string{permission.Medicine, permission.ARMOwner, permission.LaboratoryName})
+	if err != nil {
+		return err
+	}
+
+	if err := stub.DelState(key); err != nil {
+		return err
+	}
+	return stub.DelState(indexKey)
+}
+
+// getPrice reads the price of a medicine effective from the given date, nil if there is none
+func getPrice(stub shim.ChaincodeStubInterface, owner string, lab string, medicine string, effectiveFrom string) (*Price, error) {
+	key, err := stub.CreateCompositeKey(priceIndex, []string{owner, lab, medicine, effectiveFrom})
+	if err != nil {
+		return nil, err
+	}
+
+	priceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get price of %s: %s", medicine, err.Error())
+	}
+	if len(priceAsBytes) == 0 {
+		return nil, nil
+	}
+
+	price := Price{}
+	if err := json.Unmarshal(priceAsBytes, &price); err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+// getPrices lists the prices whose key starts with the given owner, lab and medicine,
+// sorted by effective date for each medicine
+func getPrices(stub shim.ChaincodeStubInterface, attributes ...string) ([]Price, error) {
+	var prices []Price
+	err := forEachByPartialKey(stub, priceIndex, attributes, func(value []byte) error {
+		price := Price{}
+		if err := json.Unmarshal(value, &price); err != nil {
+			return err
+		}
+		prices = append(prices, price)
+		return nil
+	})
+	return prices, err
+}
+
+// putPrice stores a price under price~owner~lab~medicine~effectiveFrom
+func putPrice(stub shim.ChaincodeStubInterface, price *Price) error {
+	key, err := stub.CreateCompositeKey(priceIndex, []string{price.ARMOwner, price.LaboratoryName, price.Medicine, price.EffectiveFrom})
+	if err != nil {
+		return err
+	}
+
+	price.DocType = priceDocType
+	priceAsBytes, _ := json.Marshal(price)
+	return stub.PutState(key, priceAsBytes)
+}
+
+// deletePrice removes a price from the history of its medicine
+func deletePrice(stub shim.ChaincodeStubInterface, price *Price) error {
+	key, err := stub.CreateCompositeKey(priceIndex, []string{price.ARMOwner, price.LaboratoryName, price.Medicine, price.EffectiveFrom})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// getTransfer reads the pending transfer of a laboratory, nil if there is none
+func getTransfer(stub shim.ChaincodeStubInterface, owner string, lab string) (*LaboratoryTransfer, error) {
+	key, err := stub.CreateCompositeKey(transferIndex, []string{owner, lab})
+	if err != nil {
+		return nil, err
+	}
+
+	transferAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transfer of %s: %s", lab, err.Error())
+	}
+	if len(transferAsBytes) == 0 {
+		return nil, nil
+	}
+
+	transfer := LaboratoryTransfer{}
+	if err := json.Unmarshal(transferAsBytes, &transfer); err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// putTransfer stores the pending transfer under transfer~owner~lab
+func putTransfer(stub shim.ChaincodeStubInterface, transfer *LaboratoryTransfer) error {
+	key, err := stub.CreateCompositeKey(transferIndex, []string{transfer.ARMOwner, transfer.LaboratoryName})
+	if err != nil {
+		return err
+	}
+
+	transfer.DocType = transferDocType
+	transferAsBytes, _ := json.Marshal(transfer)
+	return stub.PutState(key, transferAsBytes)
+}
+
+// deleteTransfer removes the pending transfer of a laboratory, if any
+func deleteTransfer(stub shim.ChaincodeStubInterface, owner string, lab string) error {
+	key, err := stub.CreateCompositeKey(transferIndex, []string{owner, lab})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// getMedicine reads a medicine of the registry, nil if it is not registered
+func getMedicine(stub shim.ChaincodeStubInterface, code string) (*Medicine, error) {
+	key, err := stub.CreateCompositeKey(medicineIndex, []string{code})
+	if err != nil {
+		return nil, err
+	}
+
+	medicineAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get medicine %s: %s", code, err.Error())
+	}
+	if len(medicineAsBytes) == 0 {
+		return nil, nil
+	}
+
+	medicine := Medicine{}
+	if err := json.Unmarshal(medicineAsBytes, &medicine); err != nil {
+		return nil, err
+	}
+	return &medicine, nil
+}
+
+// putMedicine stores a medicine under medicine~code
+func putMedicine(stub shim.ChaincodeStubInterface, medicine *Medicine) error {
+	key, err := stub.CreateCompositeKey(medicineIndex, []string{medicine.Code})
+	if err != nil {
+		return err
+	}
+
+	medicine.DocType = medicineDocType
+	medicineAsBytes, _ := json.Marshal(medicine)
+	return stub.PutState(key, medicineAsBytes)
+}
+
+// forEachByPartialKey calls fn with the value of every key of the given object type
+// starting with the given attributes
+func forEachByPartialKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string, fn func(value []byte) error) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := fn(queryResponse.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitAuthorizationEvent sets the named chaincode event from the last history entry of
+// the authorization. Fabric keeps one event per transaction, so it is called once, last
+func emitAuthorizationEvent(stub shim.ChaincodeStubInterface, name string, permission *MarketingAuthorization) error {
+	event := MarketingAuthorizationEvent{
+		ARMOwner:       permission.ARMOwner,
+		LaboratoryName: permission.LaboratoryName,
+		Medicine:       permission.Medicine,
+		Status:         permission.Status,
+		ValidUntil:     permission.ValidUntil,
+	}
+	if len(permission.History) > 0 {
+		last := permission.History[len(permission.History)-1]
+		event.Actor = last.Actor
+		event.Reason = last.Reason
+		event.Date = last.Date
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, payload)
+}
+
+// txDate is the transaction timestamp as RFC 3339 UTC, the same on every endorsing peer
+func txDate(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+// dateLayouts are the layouts accepted for dates passed in by callers
+var dateLayouts = []string{time.RFC3339, "02/01/2006"}
+
+// parseDate turns a date passed in by a caller into RFC 3339 UTC, as stored by arm
+func parseDate(value string) (string, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid date %s. Expecting RFC 3339 or dd/mm/yyyy", value)
 }
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
@@ -1,13 +1,121 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
+// MockStub has no client identity, identityChaincode runs the arm chaincode on a
+// stub whose creator is the client set in creator
+type identityChaincode struct {
+	scc     *SmartContract
+	creator []byte
+}
+
+type creatorStub struct {
+	*shim.MockStub
+	creator []byte
+}
+
+func (s *creatorStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (c *identityChaincode) Init(stub shim.ChaincodeStubInterface) sc.Response {
+	return c.scc.Init(&creatorStub{stub.(*shim.MockStub), c.creator})
+}
+
+func (c *identityChaincode) Invoke(stub shim.ChaincodeStubInterface) sc.Response {
+	return c.scc.Invoke(&creatorStub{stub.(*shim.MockStub), c.creator})
+}
+
+// client describes the certificate of a test client
+type client struct {
+	mspID string
+	cn    string
+	role  string
+}
+
+var (
+	regulator = client{"RegulatorMSP", "regulator1", "regulator"}
+	owner1    = client{"Org1MSP", "owner1", ""}
+	owner2    = client{"Org2MSP", "owner2", ""}
+)
+
+// newStub returns a stub for the arm chaincode invoked by the given client, and the
+// chaincode to switch clients with
+func newStub(t *testing.T, c client) (*shim.MockStub, *identityChaincode) {
+	cc := &identityChaincode{scc: new(SmartContract), creator: newCreator(t, c)}
+	return shim.NewMockStub("ex01", cc), cc
+}
+
+// newCreator builds the serialized identity of a client with a self signed certificate,
+// carrying the role attribute the way the Fabric CA issues it
+func newCreator(t *testing.T, c client) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: c.cn, Organization: []string{c.mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if c.role != "" {
+		attrs, _ := json.Marshal(map[string]map[string]string{"attrs": {"role": c.role}})
+		template.ExtraExtensions = []pkix.Extension{{Id: []int{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrs}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   c.mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+// labChaincode stands in for the lab chaincode in cross chaincode invocations
+type labChaincode struct {
+	invocations [][]string
+}
+
+func (l *labChaincode) Init(stub shim.ChaincodeStubInterface) sc.Response {
+	return shim.Success(nil)
+}
+
+func (l *labChaincode) Invoke(stub shim.ChaincodeStubInterface) sc.Response {
+	function, args := stub.GetFunctionAndParameters()
+	l.invocations = append(l.invocations, append([]string{function}, args...))
+	if args[0] != "BAYER" && args[0] != "GLX" {
+		return shim.Error("Invalid key. Expecting a LAB")
+	}
+	return shim.Success(nil)
+}
+
 ////////////////// Util Methods //////////////////
 
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
@@ -50,6 +158,40 @@ func checkQuery(t *testing.T, stub *shim.MockStub, tx string, name string, value
 	}
 }
 
+func checkQueryArgs(t *testing.T, stub *shim.MockStub, args [][]byte, values ...string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Query", string(args[0]), "failed", string(res.Message))
+		t.FailNow()
+	}
+	for _, v := range values {
+		if !strings.Contains(string(res.Payload), v) {
+			fmt.Println("Query", string(args[0]), "value was not", v, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+func checkQueryArgsExcludes(t *testing.T, stub *shim.MockStub, args [][]byte, values ...string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Query", string(args[0]), "failed", string(res.Message))
+		t.FailNow()
+	}
+	for _, v := range values {
+		if strings.Contains(string(res.Payload), v) {
+			fmt.Println("Query", string(args[0]), "value contained", v, "unexpectedly")
+			t.FailNow()
+		}
+	}
+}
+
+func registerMedicines(t *testing.T, stub *shim.MockStub, codes ...string) {
+	for _, code := range codes {
+		checkInvoke(t, stub, [][]byte{[]byte("registerMedicine"), []byte(code), []byte(code + " 600 mg"), []byte("Ibuprofen"), []byte("M01AE01"), []byte("Tablet"), []byte("600 mg"), []byte("40")})
+	}
+}
+
 func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInvoke("1", args)
 	if res.Status != shim.OK {
@@ -58,6 +200,28 @@ func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	}
 }
 
+// checkEvent takes the next authorization event off the stub and checks its name and payload
+func checkEvent(t *testing.T, stub *shim.MockStub, name string, values ...string) {
+	var payload []byte
+	select {
+	case event := <-stub.ChaincodeEventsChannel:
+		if event.EventName != name {
+			fmt.Println("Event", name, "was", event.EventName, "instead")
+			t.FailNow()
+		}
+		payload = event.Payload
+	default:
+		fmt.Println("Event", name, "was not emitted")
+		t.FailNow()
+	}
+	for _, v := range values {
+		if !strings.Contains(string(payload), v) {
+			fmt.Println("Event", name, "value was not", v, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
 func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInvoke("1", args)
 	if res.Status != shim.ERROR {
@@ -66,22 +230,29 @@ func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	}
 }
 
+// checkInvokeErrorWithoutEvent also checks that the failed transaction left no event behind
+func checkInvokeErrorWithoutEvent(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	checkInvokeError(t, stub, args)
+	if len(stub.ChaincodeEventsChannel) != 0 {
+		fmt.Println("Invoke", string(args[0]), "failed but emitted", (<-stub.ChaincodeEventsChannel).EventName)
+		t.FailNow()
+	}
+}
+
 ////////////////// Tests //////////////////
 
 func Test_addArm(t *testing.T) {
-	scc := new(SmartContract)
-	stub := shim.NewMockStub("ex01", scc)
+	stub, _ := newStub(t, regulator)
 
 	// addARM
 	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
 
-	checkState(t, stub, "ARM1", "ARM1")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "ARM1")
 
 }
 
 func Test_addLaboratory(t *testing.T) {
-	scc := new(SmartContract)
-	stub := shim.NewMockStub("ex01", scc)
+	stub, _ := newStub(t, regulator)
 
 	// addARM
 	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
@@ -92,15 +263,14 @@ func Test_addLaboratory(t *testing.T) {
 	// addLaboratory
 	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
 
-	checkState(t, stub, "ARM1", "ARM1")
-	checkState(t, stub, "ARM1", "BAYER")
-	checkState(t, stub, "ARM1", "GLX")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "ARM1")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "BAYER")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "GLX")
 
 }
 
 func Test_addLaboratoryError(t *testing.T) {
-	scc := new(SmartContract)
-	stub := shim.NewMockStub("ex01", scc)
+	stub, _ := newStub(t, regulator)
 
 	// addARM
 	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
@@ -111,19 +281,20 @@ func Test_addLaboratoryError(t *testing.T) {
 }
 
 func Test_addLaboratoryWithoutArmError(t *testing.T) {
-	scc := new(SmartContract)
-	stub := shim.NewMockStub("ex01", scc)
+	stub, _ := newStub(t, regulator)
 
 	// addLaboratory
-	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+
+	checkInvokeError(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM1")})
 
 }
 
 func Test_addPermission(t *testing.T) {
-	scc := new(SmartContract)
-	stub := shim.NewMockStub("ex01", scc)
+	stub, _ := newStub(t, regulator)
 
 	// addARM
+	registerMedicines(t, stub, "Med1", "Med2")
 	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
 
 	// addLaboratory
@@ -138,16 +309,640 @@ func Test_addPermission(t *testing.T) {
 	// addMarketingAuthorization
 	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2"), []byte("10/12/2018")})
 
-	checkState(t, stub, "ARM1", "ARM1")
-	checkState(t, stub, "ARM1", "BAYER")
-	checkState(t, stub, "ARM1", "GLX")
-	checkState(t, stub, "ARM1", "Med1")
-	checkState(t, stub, "ARM1", "Med2")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "ARM1")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "BAYER")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "GLX")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "Med1")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "Med2")
+
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "Med1", "Med2")
+
+	// func checkQuery(t *testing.T, stub *shim.MockStub, tx string, name string, values ...string) {
+	// func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	// func checkState(t *testing.T, stub *shim.MockStub, name string, values ...string) {
+
+}
+
+func Test_approvePermission(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"SUBMITTED\"", "\"authDate\":\"\"")
+
+	// the same medicine cannot be submitted twice while the first one is live
+	checkInvokeError(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("11/10/2018")})
+
+	// a submitted authorization has to be reviewed before it is approved
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("cheap"), []byte("Dossier complete")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"APPROVED\"", "\"price\":\"12.50\"", "\"actor\":\"RegulatorMSP/CN=regulator1,O=RegulatorMSP\"", "\"reason\":\"Dossier complete\"")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM1")}, "\"authDate\":\"\"")
+
+	// unknown authorizations cannot be approved
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("GLX"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+}
+
+func Test_suspendAndRevokePermission(t *testing.T) {
+	stub, cc := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+
+	// only approved authorizations can be suspended
+	checkInvokeError(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+
+	// a reason is mandatory
+	checkInvokeError(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("")})
+	checkInvoke(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"SUSPENDED\"", "\"reason\":\"Inspection\"")
+	approval := func() MarketingAuthorization {
+		var permissions []MarketingAuthorization
+		json.Unmarshal(stub.MockInvoke("1", [][]byte{[]byte("queryAuthorizations"), []byte("ARM1"), []byte("BAYER")}).Payload, &permissions)
+		return permissions[0]
+	}
+	suspended := approval()
+
+	// lifting the suspension keeps the original approval, its price and its validity
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("9.99"), []byte("Inspection passed")})
+	checkInvokeError(t, stub, [][]byte{[]byte("reinstateMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("")})
+	checkInvoke(t, stub, [][]byte{[]byte("reinstateMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection passed")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"APPROVED\"", "\"price\":\"12.50\"", "\"reason\":\"Inspection passed\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceHistory"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")}, "\"amount\":\"12.50\"")
+	if strings.Contains(string(stub.MockInvoke("1", [][]byte{[]byte("queryPriceHistory"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")}).Payload), "9.99") {
+		fmt.Println("Reinstating the authorization changed its price")
+		t.FailNow()
+	}
+	if reinstated := approval(); reinstated.AuthDate != suspended.AuthDate || reinstated.ValidUntil != suspended.ValidUntil || reinstated.ReviewCycle != suspended.ReviewCycle {
+		fmt.Println("Reinstating the authorization changed its approval", suspended, reinstated)
+		t.FailNow()
+	}
+	checkInvokeError(t, stub, [][]byte{[]byte("reinstateMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection passed")})
+	checkInvoke(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+
+	cc.creator = newCreator(t, client{"RegulatorMSP", "regulator2", "regulator"})
+	checkInvoke(t, stub, [][]byte{[]byte("revokeMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Safety alert")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"REVOKED\"", "\"actor\":\"RegulatorMSP/CN=regulator2,O=RegulatorMSP\"", "\"reason\":\"Safety alert\"")
+
+	// revocation is final, but the medicine can be submitted again
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("11/10/2019")})
+	checkInvoke(t, stub, [][]byte{[]byte("rejectMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Incomplete dossier")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"REJECTED\"")
+}
+
+func Test_renewAndExpirePermission(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
 
-	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM2")
+	soon := time.Now().UTC().AddDate(0, 0, 10).Format("02/01/2006")
+	later := time.Now().UTC().AddDate(0, 0, 100).Format("02/01/2006")
+
+	registerMedicines(t, stub, "Med1", "Med2")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2"), []byte("10/10/2018")})
+	for _, medicine := range []string{"Med1", "Med2"} {
+		checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte(medicine)})
+	}
+
+	// a validity window cannot end before it starts
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete"), []byte("01/01/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete"), []byte(soon)})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2"), []byte("3.10"), []byte("Dossier complete")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"reviewCycle\":1")
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryExpiringAuthorizations"), []byte("ARM1"), []byte("30")}, "Med1")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryExpiringAuthorizations"), []byte("ARM1"), []byte("30")}, "Med2")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryExpiringAuthorizations"), []byte("ARM1"), []byte("5")}, "Med1")
+	checkInvokeError(t, stub, [][]byte{[]byte("queryExpiringAuthorizations"), []byte("ARM1"), []byte("soon")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("renewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Periodic review"), []byte(later)})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"reviewCycle\":2", "\"reason\":\"Periodic review\"")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryExpiringAuthorizations"), []byte("ARM1"), []byte("30")}, "Med1")
+
+	// let the Med1 window run out
+	key, _ := stub.CreateCompositeKey(authorizationIndex, []string{"ARM1", "BAYER", "Med1"})
+	permission := MarketingAuthorization{}
+	json.Unmarshal(stub.State[key], &permission)
+	permission.ValidUntil = "2018-12-31T00:00:00Z"
+	stub.State[key], _ = json.Marshal(permission)
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM1")}, "\"status\":\"EXPIRED\"")
+	checkInvokeError(t, stub, [][]byte{[]byte("renewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Periodic review")})
+	checkInvokeError(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+
+	// an expired medicine can be submitted again
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("01/01/2019")})
+}
+
+func Test_addLaboratoryTwiceError(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("Other ARM")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "My ARM")
+
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+
+	// authorizations are only granted to labs of the ARM, and only in existing ARMs
+	checkInvokeError(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("GLX"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM2"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvokeError(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM2")})
+}
 
-// func checkQuery(t *testing.T, stub *shim.MockStub, tx string, name string, values ...string) {
-// func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
-// func checkState(t *testing.T, stub *shim.MockStub, name string, values ...string) {
+func Test_removeLaboratory(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
 
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+
+	// a lab with a live authorization stays
+	checkInvokeError(t, stub, [][]byte{[]byte("removeLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvokeError(t, stub, [][]byte{[]byte("removeLaboratory"), []byte("ARM1"), []byte("ROCHE")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("rejectMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Incomplete dossier")})
+	checkInvoke(t, stub, [][]byte{[]byte("removeLaboratory"), []byte("ARM1"), []byte("BAYER")})
+
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "GLX")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM1")}, "BAYER")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryLaboratoryOwners"), []byte("BAYER")}, "[]")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryLaboratoryOwners"), []byte("GLX")}, "[\"ARM1\"]")
+}
+
+func Test_transferLaboratory(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+
+	registerMedicines(t, stub, "Med1", "Med2")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM2"), []byte("Other ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("GLX"), []byte("Med2"), []byte("10/10/2018")})
+
+	checkInvokeError(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("BAYER"), []byte("ARM3")})
+	checkInvokeError(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM2"), []byte("BAYER"), []byte("ARM1")})
+	checkInvoke(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+
+	// nothing moves until the receiving ARM accepts
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "BAYER", "Med1")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM2")}, "BAYER")
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("GLX"), []byte("ARM2")})
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER"), []byte("ARM1")})
+
+	// a cancelled transfer can no longer be accepted
+	checkInvoke(t, stub, [][]byte{[]byte("cancelLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER")})
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+	checkInvokeError(t, stub, [][]byte{[]byte("cancelLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+	checkInvoke(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM2", "BAYER", "Med1")
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "GLX", "Med2")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM1")}, "BAYER", "Med1")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryLaboratoryOwners"), []byte("BAYER")}, "[\"ARM2\"]")
+
+	// the authorization keeps its workflow in the new ARM
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM2"), []byte("BAYER"), []byte("Med1")})
+}
+
+func Test_createLaboratoryWithARMKey(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("BAYER"), []byte("Bayer ARM")})
+
+	// a lab named like an ARM lives in its own namespace
+	checkInvoke(t, stub, [][]byte{[]byte("createLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvokeError(t, stub, [][]byte{[]byte("createLaboratory"), []byte("ARM3"), []byte("BAYER")})
+
+	armKey, _ := stub.CreateCompositeKey(armIndex, []string{"BAYER"})
+	labKey, _ := stub.CreateCompositeKey(laboratoryIndex, []string{"ARM1", "BAYER"})
+	checkState(t, stub, armKey, "\"docType\":\"arm\"", "Bayer ARM")
+	checkState(t, stub, labKey, "\"docType\":\"laboratory\"", "\"armOwner\":\"ARM1\"")
+
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("BAYER"), []byte("GLX")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryARMs")}, "My ARM", "Bayer ARM")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryARMs")}, "GLX", "Med1")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryLaboratories")}, "\"laboratoryName\":\"BAYER\"", "\"laboratoryName\":\"GLX\"")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryLaboratories"), []byte("BAYER")}, "\"laboratoryName\":\"BAYER\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryLabsJSON"), []byte("ARM1")}, "[{\"LaboratoryName\":\"BAYER\",\"ARMOwner\":\"ARM1\"}]")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("ARM1"), []byte("BAYER")}, "Med1")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("BAYER")}, "[]")
+}
+
+func Test_legacyARM(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	registerMedicines(t, stub, "Med1", "Med2")
+
+	// an ARM as addARM stored it before the arm namespace, and a bare laboratory as the first createLaboratory did
+	stub.MockTransactionStart("legacy")
+	stub.PutState("ARM1", []byte(`{"owner":"ARM1","desc":"My ARM","laboratory":[{"laboratoryName":"BAYER"},{"laboratoryName":"GLX"}],`+
+		`"authorizations":[{"laboratoryName":"BAYER","medicine":"Med1","createdDate":"01/01/2018","authDate":"","price":"12.50"}]}`))
+	stub.PutState("ARM2", []byte(`{"laboratoryName":"BAYER"}`))
+	stub.MockTransactionEnd("legacy")
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByMarketingAuthorization"), []byte("ARM1")}, "My ARM", "\"laboratoryName\":\"GLX\"", "12.50")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("ARM1"), []byte("BAYER")}, "Med1")
+	checkInvokeError(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
+
+	// a legacy authorization is still submitted, and once reviewed lives under its own key
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("ARM1")}, "UNDER_REVIEW")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("ARM1")}, "\"status\":\"\"")
+
+	// removing a laboratory moves the ARM into the namespace first
+	checkInvoke(t, stub, [][]byte{[]byte("removeLaboratory"), []byte("ARM1"), []byte("GLX")})
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryLaboratories"), []byte("ARM1")}, "GLX")
+	if stub.State["ARM1"] != nil {
+		fmt.Println("State ARM1 was not removed as expected")
+		t.FailNow()
+	}
+
+	armKey, _ := stub.CreateCompositeKey(armIndex, []string{"ARM1"})
+	labKey, _ := stub.CreateCompositeKey(laboratoryIndex, []string{"ARM1", "BAYER"})
+	checkState(t, stub, armKey, "\"docType\":\"arm\"", "My ARM")
+	checkState(t, stub, labKey, "\"armOwner\":\"ARM1\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("ARM1")}, "UNDER_REVIEW")
+}
+
+func Test_migrateARMs(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+
+	stub.MockTransactionStart("legacy")
+	stub.PutState("ARM1", []byte(`{"owner":"ARM1","desc":"My ARM","laboratory":[{"laboratoryName":"BAYER"}],`+
+		`"authorizations":[{"laboratoryName":"BAYER","medicine":"Med1","createdDate":"01/01/2018","authDate":"","price":"12.50"}]}`))
+	stub.PutState("ARM2", []byte(`{"laboratoryName":"BAYER"}`))
+	stub.MockTransactionEnd("legacy")
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("migrateARMs"), []byte("ARM0"), []byte("ARM9")}, "[\"ARM1\"]")
+	checkQueryArgs(t, stub, [][]byte{[]byte("migrateARMs"), []byte("ARM0"), []byte("ARM9")}, "[]")
+
+	armKey, _ := stub.CreateCompositeKey(armIndex, []string{"ARM1"})
+	labKey, _ := stub.CreateCompositeKey(laboratoryIndex, []string{"ARM1", "BAYER"})
+	authorizationKey, _ := stub.CreateCompositeKey(authorizationIndex, []string{"ARM1", "BAYER", "Med1"})
+	checkState(t, stub, armKey, "My ARM")
+	checkState(t, stub, labKey, "BAYER")
+	checkState(t, stub, authorizationKey, "\"armOwner\":\"ARM1\"", "12.50")
+	if stub.State["ARM1"] != nil {
+		fmt.Println("State ARM1 was not removed as expected")
+		t.FailNow()
+	}
+	checkState(t, stub, "ARM2", "BAYER")
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryARMs")}, "My ARM")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")}, "12.50")
+}
+
+func Test_priceHistory(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	today := time.Now().UTC()
+	next := today.AddDate(0, 1, 0).Format("02/01/2006")
+	later := today.AddDate(0, 2, 0).Format("02/01/2006")
+	between := today.AddDate(0, 1, 15).Format("02/01/2006")
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM2"), []byte("Other ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+
+	// prices can only be proposed for approved medicines
+	checkInvokeError(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("13.10 EUR"), []byte(next)})
+
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50 euros"), []byte("Dossier complete")})
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("1e3"), []byte("Dossier complete")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"price\":\"12.50\"", "\"currency\":\"EUR\"")
+
+	// retroactive prices are not accepted
+	checkInvokeError(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("13.10 EUR"), []byte("01/01/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("13.10 EUR"), []byte(next)})
+	checkInvokeError(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("13.20 EUR"), []byte(next)})
+	checkInvoke(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("20 USD"), []byte(later)})
+
+	// proposals are not in force until they are approved
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceOnDate"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(between)}, "\"amount\":\"12.50\"")
+
+	checkInvoke(t, stub, [][]byte{[]byte("approvePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(next), []byte("Cost study accepted")})
+	checkInvoke(t, stub, [][]byte{[]byte("rejectPriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(later), []byte("Unjustified")})
+	checkInvokeError(t, stub, [][]byte{[]byte("approvePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(later), []byte("Unjustified")})
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceOnDate"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(between)}, "\"amount\":\"13.10\"", "\"decidedBy\":\"RegulatorMSP/CN=regulator1,O=RegulatorMSP\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceOnDate"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(today.AddDate(1, 0, 0).Format("02/01/2006"))}, "\"amount\":\"13.10\"")
+	checkInvokeError(t, stub, [][]byte{[]byte("queryPriceOnDate"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("01/01/2018")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceHistory"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")}, "\"status\":\"APPROVED\"", "\"status\":\"REJECTED\"", "\"currency\":\"USD\"")
+
+	// the price history follows the lab
+	checkInvoke(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+	checkInvoke(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceOnDate"), []byte("ARM2"), []byte("BAYER"), []byte("Med1"), []byte(between)}, "\"amount\":\"13.10\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceHistory"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")}, "[]")
+}
+
+func Test_decidePriceChangeOfRevokedAuthorization(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	next := time.Now().UTC().AddDate(0, 1, 0).Format("02/01/2006")
+	later := time.Now().UTC().AddDate(0, 2, 0).Format("02/01/2006")
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+	checkInvoke(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("13.10 EUR"), []byte(next)})
+	checkInvoke(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("14.00 EUR"), []byte(later)})
+
+	// a suspension does not stop the price from being decided
+	checkInvoke(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+	checkInvoke(t, stub, [][]byte{[]byte("approvePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(next), []byte("Cost study accepted")})
+
+	// a revocation does, but pending proposals can still be turned down
+	checkInvoke(t, stub, [][]byte{[]byte("revokeMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Safety alert")})
+	checkInvokeError(t, stub, [][]byte{[]byte("approvePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(later), []byte("Cost study accepted")})
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryPriceOnDate"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(time.Now().UTC().AddDate(1, 0, 0).Format("02/01/2006"))}, "14.00")
+	checkInvoke(t, stub, [][]byte{[]byte("rejectPriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(later), []byte("Authorization revoked")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceHistory"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")}, "\"reason\":\"Authorization revoked\"")
+}
+
+func Test_syncLaboratory(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	lab := new(labChaincode)
+	stub.MockPeerChaincode("labcc/labchannel", shim.NewMockStub("labcc", lab))
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("labcc"), []byte("labchannel")})
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("ROCHE")})
+	for _, lab := range []string{"BAYER", "ROCHE"} {
+		checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte(lab), []byte("Med1"), []byte("10/10/2018")})
+		checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte(lab), []byte("Med1")})
+	}
+
+	// only the decisions that change what a lab may sell are pushed
+	if len(lab.invocations) != 0 {
+		fmt.Println("Lab chaincode was invoked", lab.invocations)
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete"), []byte("01/01/2030")})
+	checkInvoke(t, stub, [][]byte{[]byte("renewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Periodic review"), []byte("01/01/2035")})
+	checkInvoke(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+	checkInvoke(t, stub, [][]byte{[]byte("revokeMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Safety alert")})
+
+	// the validity window travels with the status, so the lab stops taking orders once it is over
+	expected := []string{"ACTIVE 2030-01-01T00:00:00Z", "ACTIVE 2035-01-01T00:00:00Z", "SUSPENDED 2035-01-01T00:00:00Z", "REVOKED 2035-01-01T00:00:00Z"}
+	if len(lab.invocations) != len(expected) {
+		fmt.Println("Lab chaincode invocations were", lab.invocations)
+		t.FailNow()
+	}
+	for i, status := range expected {
+		if strings.Join(lab.invocations[i], " ") != "setAuthorizationStatus BAYER Med1 "+status {
+			fmt.Println("Lab chaincode invocation was", lab.invocations[i])
+			t.FailNow()
+		}
+	}
+
+	// a lab unknown to the lab chaincode keeps the authorization under review
+	checkInvokeError(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("ROCHE"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizations"), []byte("ARM1"), []byte("ROCHE")}, "\"status\":\"UNDER_REVIEW\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPriceHistory"), []byte("ARM1"), []byte("ROCHE"), []byte("Med1")}, "[]")
+}
+
+func Test_syncRejectionAndExpiry(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	lab := new(labChaincode)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", lab))
+
+	registerMedicines(t, stub, "Med1", "Med2")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	for _, medicine := range []string{"Med1", "Med2"} {
+		checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte(medicine), []byte("10/10/2018")})
+		checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte(medicine)})
+	}
+
+	// a rejection reaches the lab, which would otherwise keep the request pending
+	checkInvoke(t, stub, [][]byte{[]byte("rejectMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Incomplete dossier")})
+	if len(lab.invocations) != 1 || strings.Join(lab.invocations[0], " ") != "setAuthorizationStatus BAYER Med1 REJECTED" {
+		fmt.Println("Lab chaincode invocations were", lab.invocations)
+		t.FailNow()
+	}
+
+	// the expiry can only be recorded once the validity window is over
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2"), []byte("3.10"), []byte("Dossier complete"), []byte("01/01/2030")})
+	checkInvokeError(t, stub, [][]byte{[]byte("expireMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2")})
+	checkInvokeError(t, stub, [][]byte{[]byte("expireMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+
+	key, _ := stub.CreateCompositeKey(authorizationIndex, []string{"ARM1", "BAYER", "Med2"})
+	permission := MarketingAuthorization{}
+	json.Unmarshal(stub.State[key], &permission)
+	permission.ValidUntil = "2018-12-31T00:00:00Z"
+	stub.State[key], _ = json.Marshal(permission)
+
+	checkInvoke(t, stub, [][]byte{[]byte("expireMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2")})
+	if last := strings.Join(lab.invocations[len(lab.invocations)-1], " "); last != "setAuthorizationStatus BAYER Med2 EXPIRED 2018-12-31T00:00:00Z" {
+		fmt.Println("Lab chaincode invocation was", last)
+		t.FailNow()
+	}
+	checkState(t, stub, key, "\"status\":\"EXPIRED\"", "Validity ended on 2018-12-31T00:00:00Z")
+
+	// the expiry is recorded once
+	checkInvokeError(t, stub, [][]byte{[]byte("expireMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2")})
+}
+
+func Test_ownerPermissions(t *testing.T) {
+	stub, cc := newStub(t, regulator)
+	registerMedicines(t, stub, "Med1", "Med2")
+	cc.creator = newCreator(t, owner1)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"mspId\":\"Org1MSP\"", "CN=owner1")
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "\"status\":\"SUBMITTED\",\"actor\":\"Org1MSP/CN=owner1,O=Org1MSP\"")
+
+	// owners cannot decide on their own authorizations
+	checkInvokeError(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("setLabChaincode"), []byte("labcc"), []byte("labchannel")})
+
+	// nor can anyone else change the ARM
+	cc.creator = newCreator(t, owner2)
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM2"), []byte("Other ARM")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med2"), []byte("10/10/2018")})
+	checkInvokeError(t, stub, [][]byte{[]byte("removeLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvokeError(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("BAYER"), []byte("ARM2")})
+
+	// the same name in another organization is someone else
+	cc.creator = newCreator(t, client{"Org2MSP", "owner1", ""})
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
+
+	// queries stay open
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM1", "BAYER", "Med1")
+
+	// regulators act on any ARM
+	cc.creator = newCreator(t, regulator)
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("GLX")})
+
+	cc.creator = newCreator(t, owner1)
+	checkInvoke(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("13.10"), []byte(time.Now().UTC().AddDate(0, 1, 0).Format("02/01/2006"))})
+	checkInvokeError(t, stub, [][]byte{[]byte("approvePriceChange"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte(time.Now().UTC().AddDate(0, 1, 0).Format("02/01/2006")), []byte("Self approved")})
+	checkInvoke(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("GLX"), []byte("ARM2")})
+
+	// only the receiving owner accepts a transfer
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("GLX"), []byte("ARM2")})
+	cc.creator = newCreator(t, owner2)
+	checkInvoke(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("GLX"), []byte("ARM2")})
+	checkQuery(t, stub, "queryByMarketingAuthorization", "ARM2", "GLX")
+}
+
+func Test_registerMedicine(t *testing.T) {
+	stub, cc := newStub(t, regulator)
+
+	checkInvoke(t, stub, [][]byte{[]byte("registerMedicine"), []byte("IBU600"), []byte("Ibuprofeno 600 mg"), []byte("Ibuprofen"), []byte("M01AE01"), []byte("Film-coated tablet"), []byte("600 mg"), []byte("40")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryMedicine"), []byte("IBU600")}, "\"atc\":\"M01AE01\"", "\"packSize\":40", "\"docType\":\"medicine\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryMedicines")}, "IBU600")
+	checkInvokeError(t, stub, [][]byte{[]byte("queryMedicine"), []byte("ASP500")})
+
+	checkInvokeError(t, stub, [][]byte{[]byte("registerMedicine"), []byte("IBU600"), []byte("Ibuprofeno 600 mg"), []byte("Ibuprofen"), []byte("M01AE01"), []byte("Film-coated tablet"), []byte("600 mg"), []byte("40")})
+	checkInvokeError(t, stub, [][]byte{[]byte("registerMedicine"), []byte("ASP500"), []byte("Aspirina 500 mg"), []byte("Acetylsalicylic acid"), []byte("N02"), []byte("Tablet"), []byte("500 mg"), []byte("20")})
+	checkInvokeError(t, stub, [][]byte{[]byte("registerMedicine"), []byte("ASP500"), []byte("Aspirina 500 mg"), []byte("Acetylsalicylic acid"), []byte("N02BA01"), []byte("Tablet"), []byte("500 mg"), []byte("0")})
+	checkInvokeError(t, stub, [][]byte{[]byte("registerMedicine"), []byte("ASP500"), []byte(""), []byte("Acetylsalicylic acid"), []byte("N02BA01"), []byte("Tablet"), []byte("500 mg"), []byte("20")})
+
+	// only regulators keep the registry
+	cc.creator = newCreator(t, owner1)
+	checkInvokeError(t, stub, [][]byte{[]byte("registerMedicine"), []byte("ASP500"), []byte("Aspirina 500 mg"), []byte("Acetylsalicylic acid"), []byte("N02BA01"), []byte("Tablet"), []byte("500 mg"), []byte("20")})
+
+	// authorizations are only granted for registered medicines
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("ASP500"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("IBU600"), []byte("10/10/2018")})
+}
+
+func Test_queryAuthorizationsByMedicine(t *testing.T) {
+	stub, _ := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+	registerMedicines(t, stub, "Med1", "Med2")
+
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM2"), []byte("Other ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM3"), []byte("Third ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM2"), []byte("GLX")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM2"), []byte("ROCHE")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM2"), []byte("GLX"), []byte("Med1"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM2"), []byte("ROCHE"), []byte("Med2"), []byte("10/10/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM2"), []byte("GLX"), []byte("Med1")})
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM2"), []byte("GLX"), []byte("Med1"), []byte("7.25"), []byte("Dossier complete")})
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")})
+	var labs []AuthorizedLaboratory
+	if res.Status != shim.OK || json.Unmarshal(res.Payload, &labs) != nil {
+		fmt.Println("queryAuthorizationsByMedicine Med1 failed", res.Message)
+		t.FailNow()
+	}
+	if len(labs) != 2 || labs[0].LaboratoryName != "BAYER" || labs[0].ARMOwner != "ARM1" || labs[0].Status != "SUBMITTED" ||
+		labs[1].LaboratoryName != "GLX" || labs[1].Status != "APPROVED" || labs[1].Price != "7.25" || labs[1].AuthDate == "" {
+		fmt.Println("queryAuthorizationsByMedicine Med1 returned", string(res.Payload))
+		t.FailNow()
+	}
+
+	// an approved price change shows once it is in force
+	next := time.Now().UTC().AddDate(0, 1, 0).Format("02/01/2006")
+	checkInvoke(t, stub, [][]byte{[]byte("proposePriceChange"), []byte("ARM2"), []byte("GLX"), []byte("Med1"), []byte("8.40 USD"), []byte(next)})
+	checkInvoke(t, stub, [][]byte{[]byte("approvePriceChange"), []byte("ARM2"), []byte("GLX"), []byte("Med1"), []byte(next), []byte("Cost study accepted")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")}, "\"price\":\"7.25\"", "\"currency\":\"EUR\"")
+
+	var prices []Price
+	json.Unmarshal(stub.MockInvoke("1", [][]byte{[]byte("queryPriceHistory"), []byte("ARM2"), []byte("GLX"), []byte("Med1")}).Payload, &prices)
+	// let time pass until the change is in force
+	stub.MockTransactionStart("backdate")
+	for i, effectiveFrom := range []string{"2018-01-01T00:00:00Z", "2019-01-01T00:00:00Z"} {
+		deletePrice(stub, &prices[i])
+		prices[i].EffectiveFrom = effectiveFrom
+		putPrice(stub, &prices[i])
+	}
+	stub.MockTransactionEnd("backdate")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")}, "\"price\":\"8.40\"", "\"currency\":\"USD\"")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")}, "7.25")
+
+	// the index follows the lab when it moves
+	checkInvoke(t, stub, [][]byte{[]byte("transferLaboratory"), []byte("ARM1"), []byte("BAYER"), []byte("ARM3")})
+	checkInvoke(t, stub, [][]byte{[]byte("acceptLaboratoryTransfer"), []byte("ARM1"), []byte("BAYER"), []byte("ARM3")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")}, "\"armOwner\":\"ARM3\"")
+	checkQueryArgsExcludes(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med1")}, "\"armOwner\":\"ARM1\"", "ROCHE")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAuthorizationsByMedicine"), []byte("Med3")}, "[]")
+}
+
+func Test_authorizationEvents(t *testing.T) {
+	stub, cc := newStub(t, regulator)
+	stub.MockPeerChaincode("lab/mychannel", shim.NewMockStub("lab", new(labChaincode)))
+
+	registerMedicines(t, stub, "Med1")
+	checkInvoke(t, stub, [][]byte{[]byte("addARM"), []byte("ARM1"), []byte("My ARM")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ARM1"), []byte("BAYER")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("10/10/2018")})
+	checkEvent(t, stub, EventAuthorizationSubmitted, "\"armOwner\":\"ARM1\"", "\"laboratoryName\":\"BAYER\"", "\"medicine\":\"Med1\"", "\"status\":\"SUBMITTED\"")
+	checkInvoke(t, stub, [][]byte{[]byte("reviewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1")})
+	checkEvent(t, stub, EventAuthorizationUnderReview, "\"actor\":\"RegulatorMSP/CN=regulator1,O=RegulatorMSP\"")
+	checkInvoke(t, stub, [][]byte{[]byte("approveMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("12.50"), []byte("Dossier complete"), []byte("01/01/2099")})
+	checkEvent(t, stub, EventAuthorizationApproved, "\"status\":\"APPROVED\"", "\"reason\":\"Dossier complete\"", "\"validUntil\":\"2099-01-01T00:00:00Z\"")
+	checkInvoke(t, stub, [][]byte{[]byte("renewMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Periodic review"), []byte("01/01/2100")})
+	checkEvent(t, stub, EventAuthorizationRenewed, "\"status\":\"APPROVED\"", "\"validUntil\":\"2100-01-01T00:00:00Z\"")
+	checkInvoke(t, stub, [][]byte{[]byte("suspendMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Inspection")})
+	checkEvent(t, stub, EventAuthorizationSuspended, "\"reason\":\"Inspection\"")
+
+	checkInvokeErrorWithoutEvent(t, stub, [][]byte{[]byte("rejectMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Too late")})
+
+	// the history names whoever decided, not what the caller claims
+	cc.creator = newCreator(t, client{"RegulatorMSP", "regulator2", "regulator"})
+	checkInvoke(t, stub, [][]byte{[]byte("revokeMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Safety alert")})
+	checkEvent(t, stub, EventAuthorizationRevoked, "\"actor\":\"RegulatorMSP/CN=regulator2,O=RegulatorMSP\"", "\"status\":\"REVOKED\"")
+	checkInvoke(t, stub, [][]byte{[]byte("addMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("11/10/2019")})
+	checkEvent(t, stub, EventAuthorizationSubmitted)
+	checkInvoke(t, stub, [][]byte{[]byte("rejectMarketingAuthorization"), []byte("ARM1"), []byte("BAYER"), []byte("Med1"), []byte("Incomplete dossier")})
+	checkEvent(t, stub, EventAuthorizationRejected, "\"reason\":\"Incomplete dossier\"")
 }
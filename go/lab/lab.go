@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -15,15 +19,231 @@ import (
 type SmartContract struct {
 }
 
+// Order statuses. An order starts as CREATED and ends as ARRIVED, CANCELLED or REJECTED
+const (
+	OrderCreated       = "CREATED"
+	OrderAcknowledged  = "ACKNOWLEDGED"
+	OrderPartiallySent = "PARTIALLY_SENT"
+	OrderSent          = "SENT"
+	OrderArrived       = "ARRIVED"
+	OrderCancelled     = "CANCELLED"
+	OrderRejected      = "REJECTED"
+)
+
+// Chaincode event names. Every transaction that changes an order emits exactly
+// one of them, carrying an OrderEvent as JSON payload
+const (
+	EventOrderCreated      = "lab.order.created"
+	EventOrderAcknowledged = "lab.order.acknowledged"
+	EventOrderSent         = "lab.order.sent"
+	EventOrderArrived      = "lab.order.arrived"
+	EventOrderCancelled    = "lab.order.cancelled"
+	EventOrderRejected     = "lab.order.rejected"
+)
+
+// EventAuthorizationSubmitted is emitted when the laboratory requests a marketing
+// authorization, carrying an AuthorizationRequestEvent. Fabric only keeps the events
+// of the chaincode the client invoked, so the one set by the arm chaincode never
+// reaches the listeners
+const EventAuthorizationSubmitted = "lab.authorization.submitted"
+
+// orderEvents maps each order status to the event emitted when an order reaches it
+var orderEvents = map[string]string{
+	OrderCreated:       EventOrderCreated,
+	OrderAcknowledged:  EventOrderAcknowledged,
+	OrderPartiallySent: EventOrderSent,
+	OrderSent:          EventOrderSent,
+	OrderArrived:       EventOrderArrived,
+	OrderCancelled:     EventOrderCancelled,
+	OrderRejected:      EventOrderRejected,
+}
+
+// orderTransitions lists the statuses an order can move to from each status
+var orderTransitions = map[string][]string{
+	OrderCreated:       {OrderAcknowledged, OrderCancelled, OrderRejected},
+	OrderAcknowledged:  {OrderPartiallySent, OrderSent, OrderCancelled, OrderRejected},
+	OrderPartiallySent: {OrderPartiallySent, OrderSent, OrderCancelled, OrderRejected},
+	OrderSent:          {OrderArrived},
+}
+
+// Document types of the persisted entities, used by CouchDB rich queries
+const (
+	labDocType    = "lab"
+	orderDocType  = "order"
+	batchDocType  = "batch"
+	stockDocType  = "stock"
+	configDocType = "config"
+)
+
+// orderIndex is the composite key object type under which orders are stored
+const orderIndex = "lab~pharmacy~orderID"
+
+// legacyOrderPrefix starts the IDs given to the orders embedded in a Laboratory before orderIndex
+const legacyOrderPrefix = "LEGACY"
+
+// Order defines a medicine order placed by a pharmacy. Orders are stored under
+// their own composite key so placing an order never rewrites the Laboratory
 type Order struct {
-	Name        string `json:"name"`
-	Desc        string `json:"desc"`
+	DocType          string     `json:"docType"`
+	ID               string     `json:"id"`
+	Laboratory       string     `json:"laboratory"`
+	Pharmacy         string     `json:"pharmacy"`
+	Name             string     `json:"name"`
+	Desc             string     `json:"desc"`
+	Quantity         int64      `json:"quantity"`
+	Outstanding      int64      `json:"outstanding"`
+	Shipments        []Shipment `json:"shipments"`
+	Status           string     `json:"status"`
+	DateCreated      string     `json:"datecreated"`
+	DateAcknowledged string     `json:"dateacknowledged"`
+	DateSent         string     `json:"datesent"`
+	DateArrival      string     `json:"datearrival"`
+	DateCancelled    string     `json:"datecancelled"`
+	DateRejected     string     `json:"daterejected"`
+	RejectReason     string     `json:"rejectreason"`
+}
+
+// OrderEvent is the payload of the order chaincode events. Shipped is only set
+// on lab.order.sent and Reason only on lab.order.rejected
+type OrderEvent struct {
+	OrderID     string `json:"orderId"`
+	Laboratory  string `json:"laboratory"`
+	Pharmacy    string `json:"pharmacy"`
+	Medicine    string `json:"medicine"`
 	Quantity    int64  `json:"quantity"`
-	DateCreated string `json:"datecreated"`
-	DateSent    string `json:"datesent"`
-	DateArrival string `json:"datearrival"`
-	DateCancelled string `json:"datecancelled"`
-	SentFlag    string `json:"sentflag"`
+	Shipped     int64  `json:"shipped,omitempty"`
+	Outstanding int64  `json:"outstanding"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"`
+	Date        string `json:"date"`
+}
+
+// AuthorizationRequestEvent is the payload of lab.authorization.submitted
+type AuthorizationRequestEvent struct {
+	ARMOwner   string `json:"armOwner"`
+	Laboratory string `json:"laboratory"`
+	Medicine   string `json:"medicine"`
+	Status     string `json:"status"`
+	Date       string `json:"date"`
+}
+
+// Shipment records a quantity of an order sent to the pharmacy
+type Shipment struct {
+	Quantity int64           `json:"quantity"`
+	DateSent string          `json:"datesent"`
+	Lots     []LotAllocation `json:"lots"`
+}
+
+// LotAllocation records how many units of a shipment were taken from a lot
+type LotAllocation struct {
+	Lot        string `json:"lot"`
+	ExpiryDate string `json:"expiryDate"`
+	Quantity   int64  `json:"quantity"`
+}
+
+// isOrderStatus reports whether status is one of the order statuses
+func isOrderStatus(status string) bool {
+	switch status {
+	case OrderCreated, OrderAcknowledged, OrderPartiallySent, OrderSent, OrderArrived, OrderCancelled, OrderRejected:
+		return true
+	}
+	return false
+}
+
+// isClosed reports whether the order has reached a final status
+func (o *Order) isClosed() bool {
+	return len(orderTransitions[o.Status]) == 0
+}
+
+// transition moves the order to the given status, stamping the matching date
+func (o *Order) transition(status string, date string) error {
+	allowed := false
+	for _, next := range orderTransitions[o.Status] {
+		if next == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("Illegal order transition: a %s order cannot be %s", o.Status, status)
+	}
+
+	switch status {
+	case OrderAcknowledged:
+		o.DateAcknowledged = date
+	case OrderSent:
+		o.DateSent = date
+	case OrderArrived:
+		o.DateArrival = date
+	case OrderCancelled:
+		o.DateCancelled = date
+	case OrderRejected:
+		o.DateRejected = date
+	}
+	o.Status = status
+	return nil
+}
+
+// ship records a shipment of the given quantity, leaving the rest of the order backordered
+func (o *Order) ship(quantity int64, date string) error {
+	if quantity <= 0 || quantity > o.Outstanding {
+		return fmt.Errorf("Invalid quantity %d. Order %s has %d outstanding", quantity, o.ID, o.Outstanding)
+	}
+
+	status := OrderSent
+	if quantity < o.Outstanding {
+		status = OrderPartiallySent
+	}
+	if err := o.transition(status, date); err != nil {
+		return err
+	}
+
+	o.Shipments = append(o.Shipments, Shipment{Quantity: quantity, DateSent: date})
+	o.Outstanding -= quantity
+	return nil
+}
+
+// Composite key object types for the laboratory inventory
+const (
+	batchIndex = "lab~medicine~lot"
+	stockIndex = "lab~medicine"
+)
+
+// Batch defines a production lot of a medicine held by a laboratory
+type Batch struct {
+	DocType           string `json:"docType"`
+	Laboratory        string `json:"laboratory"`
+	Medicine          string `json:"medicine"`
+	Lot               string `json:"lot"`
+	ManufacturingDate string `json:"manufacturingDate"`
+	ExpiryDate        string `json:"expiryDate"`
+	Quantity          int64  `json:"quantity"`
+	Available         int64  `json:"available"`
+}
+
+// isExpired reports whether the batch has expired at the given RFC 3339 UTC date.
+// Dates share the same layout so they compare lexicographically
+func (b *Batch) isExpired(date string) bool {
+	return b.ExpiryDate <= date
+}
+
+// Stock holds the units of a medicine reserved for acknowledged orders
+type Stock struct {
+	DocType    string `json:"docType"`
+	Laboratory string `json:"laboratory"`
+	Medicine   string `json:"medicine"`
+	Reserved   int64  `json:"reserved"`
+}
+
+// StockSummary is the stock position of a medicine returned by queryStock
+type StockSummary struct {
+	Laboratory string  `json:"laboratory"`
+	Medicine   string  `json:"medicine"`
+	OnHand     int64   `json:"onHand"`
+	Expired    int64   `json:"expired"`
+	Reserved   int64   `json:"reserved"`
+	Available  int64   `json:"available"`
+	Batches    []Batch `json:"batches"`
 }
 
 type Pharmacy struct {
@@ -31,26 +251,184 @@ type Pharmacy struct {
 	Order    []Order `json:"order"`
 }
 
-// MarketingAuthorization defines a marketing authorization in order to produce a medicine
+// legacyOrders lists the orders addMedicineOrder embedded in the stored laboratory before
+// orderIndex, which had neither ID nor status. They are numbered in order of appearance and
+// take their status from their dates, a sent order having been sent in full
+func (l *Laboratory) legacyOrders(lab string) []Order {
+	var orders []Order
+	for _, pharmacy := range l.Pharmacy {
+		for _, order := range pharmacy.Order {
+			order.ID = legacyOrderPrefix + strconv.Itoa(len(orders)+1)
+			order.Laboratory = lab
+			order.Pharmacy = pharmacy.Pharmacy
+			order.Outstanding = order.Quantity
+			switch {
+			case order.DateCancelled != "":
+				order.Status = OrderCancelled
+			case order.DateArrival != "":
+				order.Status = OrderArrived
+			case order.DateSent != "":
+				order.Status = OrderSent
+			default:
+				order.Status = OrderCreated
+			}
+			if order.DateSent != "" && order.Status != OrderCancelled {
+				order.Shipments = []Shipment{{Quantity: order.Quantity, DateSent: order.DateSent}}
+				order.Outstanding = 0
+			}
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+// Marketing authorization statuses. Orders are only accepted for ACTIVE authorizations
+const (
+	AuthorizationPending   = "PENDING"
+	AuthorizationActive    = "ACTIVE"
+	AuthorizationRejected  = "REJECTED"
+	AuthorizationSuspended = "SUSPENDED"
+	AuthorizationRevoked   = "REVOKED"
+	AuthorizationExpired   = "EXPIRED"
+)
+
+// MarketingAuthorization defines a marketing authorization in order to produce a medicine.
+// ValidUntil is the end of the validity window the arm chaincode approved, past it the
+// authorization takes no more orders even before the arm chaincode pushes the expiry
 type MarketingAuthorization struct {
 	Medicine    string `json:"medicine"`
 	CreatedDate string `json:"createdDate"`
+	Status      string `json:"status"`
+	ValidUntil  string `json:"validUntil,omitempty"`
 }
 
-// Laboratory defines a company wich produces medicines
+// isClosed tells whether the authorization can be requested again at the given date, which the arm
+// chaincode allows once it is rejected, revoked or past its validity window. Pending ones, like those
+// stored without a status before the approval workflow, are still open
+func (m *MarketingAuthorization) isClosed(date string) bool {
+	switch m.Status {
+	case AuthorizationRejected, AuthorizationRevoked, AuthorizationExpired:
+		return true
+	case AuthorizationActive, AuthorizationSuspended:
+		return m.ValidUntil != "" && m.ValidUntil <= date
+	case AuthorizationPending, "":
+		return false
+	}
+	return false
+}
+
+// Laboratory defines a company wich produces medicines. Only master data is
+// persisted; Pharmacy is assembled from the lab orders when querying
 type Laboratory struct {
+	DocType                string                   `json:"docType"`
 	LaboratoryName         string                   `json:"laboratoryName"`
 	CreatedDate            string                   `json:"createdDate"`
 	Address                string                   `json:"address"`
 	ARMOwner               string                   `json:"armOwner"`
 	MarketingAuthorization []MarketingAuthorization `json:"authorizations"`
-	Pharmacy               []Pharmacy               `json:"pharmacy"`
+	Pharmacy               []Pharmacy               `json:"pharmacy,omitempty"`
+}
+
+// LaboratoryEntry is the summary of a laboratory queryLabsJSON returns when no fields are
+// selected. It keeps the PascalCase keys queryLabsJSON always had, which the laboratories
+// listed by queryLabsJSON in the arm chaincode share
+type LaboratoryEntry struct {
+	LaboratoryName string `json:"LaboratoryName"`
+	CreatedDate    string `json:"CreatedDate"`
+	Address        string `json:"Address"`
+	ARMOwner       string `json:"ARMOwner"`
+}
+
+// checkAuthorization fails unless the laboratory holds a marketing authorization for the medicine
+// that is active at the given date
+func (l *Laboratory) checkAuthorization(medicine string, date string) error {
+	for _, authorization := range l.MarketingAuthorization {
+		if authorization.Medicine != medicine {
+			continue
+		}
+		switch authorization.Status {
+		case AuthorizationActive:
+			if authorization.ValidUntil != "" && authorization.ValidUntil <= date {
+				return fmt.Errorf("Marketing authorization of %s for %s expired on %s", medicine, l.LaboratoryName, authorization.ValidUntil)
+			}
+			return nil
+		case AuthorizationRejected:
+			return fmt.Errorf("Marketing authorization of %s for %s has been rejected", medicine, l.LaboratoryName)
+		case AuthorizationRevoked:
+			return fmt.Errorf("Marketing authorization of %s for %s has been revoked", medicine, l.LaboratoryName)
+		case AuthorizationExpired:
+			return fmt.Errorf("Marketing authorization of %s for %s expired on %s", medicine, l.LaboratoryName, authorization.ValidUntil)
+		case AuthorizationSuspended:
+			return fmt.Errorf("Marketing authorization of %s for %s is suspended", medicine, l.LaboratoryName)
+		case AuthorizationPending, "":
+			// authorizations requested before statuses existed have none, the arm chaincode has yet to decide on them
+			return fmt.Errorf("Marketing authorization of %s for %s is pending approval", medicine, l.LaboratoryName)
+		default:
+			return fmt.Errorf("Marketing authorization of %s for %s has the unknown status %s", medicine, l.LaboratoryName, authorization.Status)
+		}
+	}
+	return fmt.Errorf("Laboratory %s holds no marketing authorization for %s", l.LaboratoryName, medicine)
+}
+
+// configIndex is the composite key object type of the chaincode configuration
+const configIndex = "config"
+
+// Config defines where the arm chaincode is deployed
+type Config struct {
+	DocType      string `json:"docType"`
+	ARMChaincode string `json:"armChaincode"`
+	ARMChannel   string `json:"armChannel"`
+}
+
+// defaultConfig is used when the chaincode is instantiated without arguments
+var defaultConfig = Config{ARMChaincode: "arm", ARMChannel: "mychannel"}
+
+// Clients whose certificate carries the role attribute set to regulator administer the
+// chaincode, the same attribute the arm chaincode checks
+const (
+	roleAttribute = "role"
+	regulatorRole = "regulator"
+)
+
+// QueryPage is a page of query results along with the bookmark of the next page
+type QueryPage struct {
+	Records             []QueryRecord `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// LabPage is a laboratory whose pharmacies hold one page of its orders, along with the bookmark of the next page
+type LabPage struct {
+	Laboratory
+	FetchedRecordsCount int32  `json:"fetchedRecordsCount"`
+	Bookmark            string `json:"bookmark"`
+}
+
+// QueryRecord is a ledger entry returned by a query
+type QueryRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
 }
 
 var logger = *shim.NewLogger("PHALogger")
 
 // Init is called during Instantiate transaction
+// ./instantiate.sh '{"Args":["init", "arm", "mychannel"]}' labcc
+// The arm chaincode name and channel are optional and default to arm and mychannel
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+
+	config := defaultConfig
+	if len(args) == 2 {
+		config = Config{ARMChaincode: args[0], ARMChannel: args[1]}
+	} else if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 2 {ARM_CHAINCODE, CHANNEL}")
+	}
+
+	if err := putConfig(APIstub, &config); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	fmt.Printf("SmartContract has been instantiated \n")
 	return shim.Success(nil)
 }
@@ -66,16 +444,54 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.addLaboratory(APIstub, args)
 	} else if function == "queryLabByARM" {
 		return s.queryLabByARM(APIstub, args)
+	} else if function == "setARMChaincode" {
+		return s.setARMChaincode(APIstub, args)
 	} else if function == "createMarketingAuthorization" {
 		return s.createMarketingAuthorization(APIstub, args)
+	} else if function == "setAuthorizationStatus" {
+		return s.setAuthorizationStatus(APIstub, args)
+	} else if function == "syncARMOwner" {
+		return s.syncARMOwner(APIstub, args)
 	} else if function == "addMedicineOrder" {
 		return s.addMedicineOrder(APIstub, args)
 	} else if function == "SendOrder" {
 		return s.SendOrder(APIstub, args)
+	} else if function == "acknowledgeOrder" {
+		return s.acknowledgeOrder(APIstub, args)
+	} else if function == "cancelOrder" {
+		return s.cancelOrder(APIstub, args)
+	} else if function == "rejectOrder" {
+		return s.rejectOrder(APIstub, args)
+	} else if function == "confirmOrderArrival" {
+		return s.confirmOrderArrival(APIstub, args)
+	} else if function == "queryOrder" {
+		return s.queryOrder(APIstub, args)
+	} else if function == "queryBackorders" {
+		return s.queryBackorders(APIstub, args)
+	} else if function == "registerBatch" {
+		return s.registerBatch(APIstub, args)
+	} else if function == "queryStock" {
+		return s.queryStock(APIstub, args)
+	} else if function == "queryStockWithPagination" {
+		return s.queryStockWithPagination(APIstub, args)
+	} else if function == "queryOrdersByStatus" {
+		return s.queryOrdersByStatus(APIstub, args)
+	} else if function == "queryOrdersByStatusWithPagination" {
+		return s.queryOrdersByStatusWithPagination(APIstub, args)
+	} else if function == "queryOrdersByLabWithPagination" {
+		return s.queryOrdersByLabWithPagination(APIstub, args)
+	} else if function == "queryBackordersWithPagination" {
+		return s.queryBackordersWithPagination(APIstub, args)
+	} else if function == "queryLabByARMWithPagination" {
+		return s.queryLabByARMWithPagination(APIstub, args)
 	} else if function == "queryByLab" {
 		return s.queryByLab(APIstub, args)
+	} else if function == "queryByLabWithPagination" {
+		return s.queryByLabWithPagination(APIstub, args)
 	} else if function == "queryLabsJSON" {
 		return s.queryLabsJSON(APIstub, args)
+	} else if function == "migrateOrders" {
+		return s.migrateOrders(APIstub, args)
 	}
 
 	return shim.Error("Invalid Smart Contract function name.")
@@ -92,192 +508,219 @@ func (s *SmartContract) addMedicineOrder(APIstub shim.ChaincodeStubInterface, ar
 		return shim.Error("Empty key. Expecting a LAB")
 	}
 
-	current_time := time.Now().Local()
-	str := current_time.Format("02/01/2006")
+	if len(args[1]) == 0 {
+		return shim.Error("Empty key. Expecting a PHARMACY")
+	}
+
+	str, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	quantity, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || quantity <= 0 {
+		return shim.Error("Invalid quantity. Expecting a positive integer")
+	}
+
+	labAsBytes, _ := APIstub.GetState(args[0])
+	if len(labAsBytes) == 0 {
+		return shim.Error("Invalid key. Expecting a LAB")
+	}
+
+	laboratory := Laboratory{}
+	json.Unmarshal(labAsBytes, &laboratory)
+	if err := laboratory.checkAuthorization(args[2], str); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkMedicine(APIstub, args[2]); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	quantity, _ := strconv.ParseInt(args[4], 10, 64)
 	var order = Order{
+		ID:          APIstub.GetTxID(),
+		Laboratory:  args[0],
+		Pharmacy:    args[1],
 		Name:        args[2],
 		Desc:        args[3],
 		Quantity:    quantity,
+		Outstanding: quantity,
+		Status:      OrderCreated,
 		DateCreated: str,
-		DateSent:    "",
-		DateArrival: "",
-		DateCancelled: "",
-		SentFlag:    "",
 	}
 
-	labAsBytes, _ := APIstub.GetState(args[0])
-	laboratory := Laboratory{}
-	json.Unmarshal(labAsBytes, &laboratory)
+	existing, _, err := getOrder(APIstub, order.Laboratory, order.Pharmacy, order.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Order " + order.ID + " already exists")
+	}
 
-	existe := 0
-	for _, pha := range laboratory.Pharmacy {
-		if pha.Pharmacy == args[1] {
-			existe = 1
-		}
+	if err := putOrder(APIstub, &order); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := emitOrderEvent(APIstub, &order, 0, str); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	if existe == 0 { // crea una nueva estructura farmacia e incorpora el pedido
-		var pharmacy = Pharmacy{
-			Pharmacy: args[1],
-			Order:    []Order{order},
-		}
+	return shim.Success([]byte(order.ID))
+}
 
-		laboratory.Pharmacy = append(laboratory.Pharmacy, pharmacy)
+// ./executeTransaction.sh '{"Args":["SendOrder", "BAYER", "FarmaciaAluche", "ORDERID", "5"]}' labcc
+// QUANTITY is optional, the whole outstanding quantity is sent when it is omitted
+func (s *SmartContract) SendOrder(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
 
-		labAsBytes, _ := json.Marshal(laboratory)
-		APIstub.PutState(args[0], labAsBytes)
-		fmt.Println("!!! appended PHA")
+	order, _, err := getOrder(APIstub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if order == nil {
+		return shim.Error("Failed to get specified Order")
+	}
 
-	} else { // recorrer farmacias y append en la que aplique
-		l := 0
-		for i, pha := range laboratory.Pharmacy {
-			if pha.Pharmacy == args[1] {
-				l = i
-				break
-			}
+	quantity := order.Outstanding
+	if len(args) == 4 {
+		quantity, err = strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid quantity. Expecting a positive integer")
 		}
+	}
+
+	str, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := order.ship(quantity, str); err != nil {
+		return shim.Error(err.Error())
+	}
 
-		laboratory.Pharmacy[l].Order = append(laboratory.Pharmacy[l].Order, order)
+	lots, err := allocateLots(APIstub, order.Laboratory, order.Name, quantity, str)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	order.Shipments[len(order.Shipments)-1].Lots = lots
 
-		labAsBytes, _ = json.Marshal(laboratory)
-		APIstub.PutState(args[0], labAsBytes)
-		fmt.Println("!!! appended order to PHA")
+	if err := putOrder(APIstub, order); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := emitOrderEvent(APIstub, order, quantity, str); err != nil {
+		return shim.Error(err.Error())
 	}
 
 	return shim.Success(nil)
 }
 
-// ./executeTransaction.sh '{"Args":["SendOrder", "FarmaciaAluche", "01/07/2018"]}' labcc
-// ./executeTransaction.sh '{"Args":["create", "FarmaciaAluche", "IBUPROFENO", "IBUPROFENODESC", "7", "FECHA"]}' phacc
-// ./executeTransaction.sh '{"Args":["create", "BAYERN", FarmaciaAluche", "IBUPROFENO", "IBUPROFENODESC", "7", "FECHA"]}' phacc
-func (s *SmartContract) SendOrder(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 6 {
-		return shim.Error("Incorrect number of arguments. Expecting 6")
+// ./executeTransaction.sh '{"Args":["acknowledgeOrder", "BAYER", "FarmaciaAluche", "ORDERID"]}' labcc
+func (s *SmartContract) acknowledgeOrder(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
-	labAsBytes, err := APIstub.GetState(args[0])
-	if err != nil {
-		return shim.Error("Failed to get specified Lab")
-	}
+	return s.updateOrderStatus(APIstub, args, OrderAcknowledged, "")
+}
 
-	labStruct := Laboratory{}
-	json.Unmarshal(labAsBytes, &labStruct)
-
-	foundPharma := false
-	foundOrder := false
-	pahrmaIndex := 0
-	orderIndex := 0
-	quantity, _ := strconv.ParseInt(args[4], 10, 64)
-	for i, pharma := range labStruct.Pharmacy {
-		if pharma.Pharmacy == args[1] {
-			foundPharma = true
-			pahrmaIndex = i
-			for j, order := range pharma.Order {
-				if (order.Name == args[2] && order.Desc == args[3] && order.Quantity == quantity && order.DateCancelled == "") {
-					foundOrder = true
-					orderIndex = j
-					break
-				}
-			}
-			break
-		}
+// ./executeTransaction.sh '{"Args":["cancelOrder", "BAYER", "FarmaciaAluche", "ORDERID"]}' labcc
+func (s *SmartContract) cancelOrder(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
-	current_time := time.Now().Local()
-	str := current_time.Format("02/01/2006")
-	labStruct.Pharmacy[pahrmaIndex].Order[orderIndex].SentFlag = "true"
-	labStruct.Pharmacy[pahrmaIndex].Order[orderIndex].DateSent = str
 
-	if (foundPharma) {
-		if (foundOrder) {
-			labAsBytes, _ := json.Marshal(labStruct)
-			APIstub.PutState(args[0], labAsBytes)
-			return shim.Success(nil)
-		} else {
-			return shim.Error("Failed to get specified Order")
-		}
-	} else {
-		return shim.Error("Failed to get specified Pharma")
-	}
+	return s.updateOrderStatus(APIstub, args, OrderCancelled, "")
 }
 
-// ./executeTransaction.sh '{"Args":["createMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "01/07/2018"]}' labcc
-func (s *SmartContract) createMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-
+// ./executeTransaction.sh '{"Args":["rejectOrder", "BAYER", "FarmaciaAluche", "ORDERID", "Out of stock"]}' labcc
+func (s *SmartContract) rejectOrder(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 4 {
-		return shim.Error("Expecting 4 {OWNER, LAB, MEDICINE, DATE}")
+		return shim.Error("Incorrect number of arguments. Expecting 4")
 	}
 
-	chainCodeToCall := "arm"
-	channelID := "mychannel"
-	f := "addMarketingAuthorization"
-
-	invokeArgs := toChaincodeArgs(f, args[0], args[1], args[2], args[3])
-	response := APIstub.InvokeChaincode(chainCodeToCall, invokeArgs, channelID)
-	if response.Status != shim.OK {
-		errStr := fmt.Sprintf("Failed to invoke armcc. Got error: %s", string(response.Payload))
-		fmt.Printf(errStr)
-		return shim.Error(errStr)
+	if len(args[3]) == 0 {
+		return shim.Error("Empty reason. Expecting a rejection reason")
 	}
 
-	fmt.Printf("Invoke armcc successful. Got response %s", string(response.Payload))
-
-	return shim.Success(response.Payload)
+	return s.updateOrderStatus(APIstub, args[:3], OrderRejected, args[3])
 }
 
-// ./executeTransaction.sh '{"Args":["addLaboratory", "BAYER", "01/03/2018", "calle de BAYER", "OWNER01"]}' labcc
-func (s *SmartContract) addLaboratory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+// ./executeTransaction.sh '{"Args":["confirmOrderArrival", "BAYER", "FarmaciaAluche", "ORDERID"]}' labcc
+func (s *SmartContract) confirmOrderArrival(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	return s.updateOrderStatus(APIstub, args, OrderArrived, "")
+}
+
+// updateOrderStatus moves the order identified by {LAB, PHARMACY, ORDERID} to the given status
+func (s *SmartContract) updateOrderStatus(APIstub shim.ChaincodeStubInterface, args []string, status string, reason string) sc.Response {
+	order, _, err := getOrder(APIstub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if order == nil {
+		return shim.Error("Failed to get specified Order")
 	}
 
-	var lab = Laboratory{
-		LaboratoryName:         args[0],
-		CreatedDate:            args[1],
-		Address:                args[2],
-		ARMOwner:               args[3],
-		MarketingAuthorization: nil,
-		Pharmacy:               nil,
+	str, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	previous := order.Status
+	if err := order.transition(status, str); err != nil {
+		return shim.Error(err.Error())
+	}
+	if status == OrderRejected {
+		order.RejectReason = reason
 	}
 
-	// TODO check lab already exists
+	// acknowledged orders hold a stock reservation for the units not sent yet until they
+	// are sent or closed, so closing a backorder gives back what it still reserves
+	if status == OrderAcknowledged {
+		err = reserveStock(APIstub, order.Laboratory, order.Name, order.Outstanding, str)
+	} else if (previous == OrderAcknowledged || previous == OrderPartiallySent) && (status == OrderCancelled || status == OrderRejected) {
+		err = releaseStock(APIstub, order.Laboratory, order.Name, order.Outstanding)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	labAsBytes, _ := json.Marshal(lab)
-	APIstub.PutState(args[0], labAsBytes)
+	if err := putOrder(APIstub, order); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := emitOrderEvent(APIstub, order, 0, str); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-// ./executeTransaction.sh '{"Args":["queryByLab", "BAYER"]}' labcc
-func (s *SmartContract) queryByLab(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// ./executeQuery.sh '{"Args":["queryOrder", "BAYER", "FarmaciaAluche", "ORDERID"]}' labcc
+func (s *SmartContract) queryOrder(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
-	if len(args[0]) == 0 {
-		return shim.Error("Empty key. Expecting a LAB")
+	_, orderAsBytes, err := getOrder(APIstub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	labAsBytes, _ := APIstub.GetState(args[0])
-	if len(labAsBytes) == 0 {
-		return shim.Error("Invalid key. Expecting a LAB")
+	if orderAsBytes == nil {
+		return shim.Error("Invalid key. Expecting an Order")
 	}
 
-	labStruct := Laboratory{}
-	json.Unmarshal(labAsBytes, &labStruct)
-	labAsBytes, _ = json.Marshal(labStruct)
-	return shim.Success(labAsBytes)
+	return shim.Success(orderAsBytes)
 }
 
-func (s *SmartContract) queryLabsJSON(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// ./executeTransaction.sh '{"Args":["registerBatch", "BAYER", "IBUPROFENO", "L2018-001", "01/03/2018", "01/03/2021", "1000"]}' labcc
+func (s *SmartContract) registerBatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 6 {
+		return shim.Error("Expecting 6 {LAB, MEDICINE, LOT, MANUFACTURING_DATE, EXPIRY_DATE, QUANTITY}")
 	}
 
-	if len(args[0]) == 0 {
-		return shim.Error("Empty key. Expecting a LAB")
+	if len(args[1]) == 0 || len(args[2]) == 0 {
+		return shim.Error("Empty key. Expecting a MEDICINE and a LOT")
 	}
 
 	labAsBytes, _ := APIstub.GetState(args[0])
@@ -285,62 +728,1276 @@ func (s *SmartContract) queryLabsJSON(APIstub shim.ChaincodeStubInterface, args
 		return shim.Error("Invalid key. Expecting a LAB")
 	}
 
-	labStruct := Laboratory{}
-	json.Unmarshal(labAsBytes, &labStruct)
-
-	var buffer bytes.Buffer
-	buffer.WriteString("{")
-
-	buffer.WriteString("\"LaboratoryName\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(labStruct.LaboratoryName)
-	buffer.WriteString("\"")
+	manufacturingDate, err := parseDate(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	expiryDate, err := parseDate(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if expiryDate <= manufacturingDate {
+		return shim.Error("Invalid expiry date. Expecting a date after the manufacturing date")
+	}
 
-	buffer.WriteString("\"CreatedDate\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(labStruct.CreatedDate)
-	buffer.WriteString("\"")
+	quantity, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || quantity <= 0 {
+		return shim.Error("Invalid quantity. Expecting a positive integer")
+	}
 
-	buffer.WriteString("\"Address\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(labStruct.Address)
-	buffer.WriteString("\"")
+	key, err := APIstub.CreateCompositeKey(batchIndex, []string{args[0], args[1], args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	batchAsBytes, _ := APIstub.GetState(key)
+	if len(batchAsBytes) != 0 {
+		return shim.Error("Lot " + args[2] + " already exists")
+	}
 
-	buffer.WriteString("\"ARMOwner\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(labStruct.ARMOwner)
-	buffer.WriteString("\"")
+	var batch = Batch{
+		Laboratory:        args[0],
+		Medicine:          args[1],
+		Lot:               args[2],
+		ManufacturingDate: manufacturingDate,
+		ExpiryDate:        expiryDate,
+		Quantity:          quantity,
+		Available:         quantity,
+	}
 
-	buffer.WriteString("}")
+	if err := putBatch(APIstub, &batch); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(buffer.Bytes())
+	// every medicine with lots has a stock record, the ones queryStockWithPagination pages through
+	stock, err := getStock(APIstub, batch.Laboratory, batch.Medicine)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putStock(APIstub, stock); err != nil {
+		return shim.Error(err.Error())
+	}
 
+	return shim.Success(nil)
 }
 
-// ./executeTransaction.sh '{"Args":["queryLabByARM", "BAYER"]}' labcc /// CouchDB !!!!!!!
-// _______________________________________________________________________________________
-
-func (s *SmartContract) queryLabByARM(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// ./executeQuery.sh '{"Args":["queryStock", "BAYER", "IBUPROFENO"]}' labcc
+// MEDICINE is optional, the stock of every medicine of the lab is returned when it is omitted
+func (s *SmartContract) queryStock(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
 	}
 
 	if len(args[0]) == 0 {
-		return shim.Error("Empty key. Expecting an Asset")
+		return shim.Error("Empty key. Expecting a LAB")
 	}
 
-	lab := strings.ToLower(args[0])
-
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"lab\",\"ARMowner\":\"%s\"}}", lab)
-
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	str, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	batches, err := getBatches(APIstub, args...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	summaries, err := summarizeStock(APIstub, batches, str)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	summariesAsBytes, _ := json.Marshal(summaries)
+	return shim.Success(summariesAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryStockWithPagination", "BAYER", "10", ""]}' labcc
+// Each record of the page is the StockSummary of one medicine of the lab
+func (s *SmartContract) queryStockWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {LAB, PAGESIZE, BOOKMARK}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	str, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(stockIndex, []string{args[0]}, pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	page := QueryPage{Records: []QueryRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		stock := Stock{}
+		if err := json.Unmarshal(queryResponse.Value, &stock); err != nil {
+			return shim.Error(err.Error())
+		}
+		batches, err := getBatches(APIstub, stock.Laboratory, stock.Medicine)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		summaries, err := summarizeStock(APIstub, batches, str)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, summary := range summaries {
+			summaryAsBytes, _ := json.Marshal(summary)
+			page.Records = append(page.Records, QueryRecord{Key: queryResponse.Key, Record: summaryAsBytes})
+		}
+	}
+	page.FetchedRecordsCount = metadata.FetchedRecordsCount
+	page.Bookmark = metadata.Bookmark
+
+	pageAsBytes, _ := json.Marshal(page)
+	return shim.Success(pageAsBytes)
+}
+
+// ./executeTransaction.sh '{"Args":["createMarketingAuthorization", "OWNER1", "BAYER", "IBUPROFENO", "01/07/2018"]}' labcc
+func (s *SmartContract) createMarketingAuthorization(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Expecting 4 {OWNER, LAB, MEDICINE, DATE}")
+	}
+
+	config, err := getConfig(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	f := "addMarketingAuthorization"
+
+	date, err := parseDate(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	labAsBytes, _ := APIstub.GetState(args[1])
+	if len(labAsBytes) == 0 {
+		return shim.Error("Invalid key. Expecting a LAB")
+	}
+
+	laboratory := Laboratory{}
+	json.Unmarshal(labAsBytes, &laboratory)
+
+	now, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a closed authorization may be requested again, any other is already in place
+	index := -1
+	for i, authorization := range laboratory.MarketingAuthorization {
+		if authorization.Medicine == args[2] {
+			if !authorization.isClosed(now) {
+				return shim.Error("Marketing authorization of " + args[2] + " for " + args[1] + " already exists")
+			}
+			index = i
+			break
+		}
+	}
+
+	invokeArgs := toChaincodeArgs(f, args[0], args[1], args[2], date)
+	response := APIstub.InvokeChaincode(config.ARMChaincode, invokeArgs, config.ARMChannel)
+	if response.Status != shim.OK {
+		errStr := fmt.Sprintf("Failed to invoke armcc. Got error: %s", response.Message)
+		fmt.Printf(errStr)
+		return shim.Error(errStr)
+	}
+
+	fmt.Printf("Invoke armcc successful. Got response %s", string(response.Payload))
+
+	// keep the lab's own list in line with the arm ledger
+	authorization := MarketingAuthorization{
+		Medicine:    args[2],
+		CreatedDate: date,
+		Status:      AuthorizationPending,
+	}
+	if index < 0 {
+		laboratory.MarketingAuthorization = append(laboratory.MarketingAuthorization, authorization)
+	} else {
+		laboratory.MarketingAuthorization[index] = authorization
+	}
+
+	labAsBytes, _ = json.Marshal(laboratory)
+	APIstub.PutState(args[1], labAsBytes)
+
+	event := AuthorizationRequestEvent{
+		ARMOwner:   args[0],
+		Laboratory: args[1],
+		Medicine:   args[2],
+		Status:     authorization.Status,
+		Date:       date,
+	}
+	eventAsBytes, _ := json.Marshal(event)
+	if err := APIstub.SetEvent(EventAuthorizationSubmitted, eventAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(response.Payload)
+}
+
+// ./executeTransaction.sh '{"Args":["setARMChaincode", "arm", "mychannel"]}' labcc
+// Only a regulator may point the lab chaincode at another arm chaincode
+func (s *SmartContract) setARMChaincode(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Expecting 2 {ARM_CHAINCODE, CHANNEL}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty name. Expecting an ARM_CHAINCODE")
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config := Config{ARMChaincode: args[0], ARMChannel: args[1]}
+	if err := putConfig(APIstub, &config); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["setAuthorizationStatus", "BAYER", "IBUPROFENO", "ACTIVE", "2023-03-01T00:00:00Z"]}' labcc
+// The arm chaincode calls it whenever an authorization is decided on or expires, on behalf
+// of the regulator who decided it. Authorizations filed straight with the arm chaincode are
+// unknown here until then, so they are added on their first decision. VALID_UNTIL is optional
+// and replaces the end of the validity window when given
+func (s *SmartContract) setAuthorizationStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Expecting 3 or 4 {LAB, MEDICINE, STATUS[, VALID_UNTIL]}")
+	}
+
+	if len(args[1]) == 0 {
+		return shim.Error("Empty key. Expecting a MEDICINE")
+	}
+
+	switch args[2] {
+	case AuthorizationPending, AuthorizationActive, AuthorizationRejected, AuthorizationSuspended, AuthorizationRevoked, AuthorizationExpired:
+	default:
+		return shim.Error("Invalid status. Expecting PENDING, ACTIVE, REJECTED, SUSPENDED, REVOKED or EXPIRED")
+	}
+
+	validUntil := ""
+	if len(args) == 4 {
+		date, err := parseDate(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		validUntil = date
+	}
+
+	if err := checkRegulator(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	labAsBytes, _ := APIstub.GetState(args[0])
+	if len(labAsBytes) == 0 {
+		return shim.Error("Invalid key. Expecting a LAB")
+	}
+
+	laboratory := Laboratory{}
+	json.Unmarshal(labAsBytes, &laboratory)
+
+	found := false
+	for i := range laboratory.MarketingAuthorization {
+		if laboratory.MarketingAuthorization[i].Medicine == args[1] {
+			laboratory.MarketingAuthorization[i].Status = args[2]
+			if validUntil != "" {
+				laboratory.MarketingAuthorization[i].ValidUntil = validUntil
+			}
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		date, err := txDate(APIstub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		laboratory.MarketingAuthorization = append(laboratory.MarketingAuthorization, MarketingAuthorization{
+			Medicine:    args[1],
+			CreatedDate: date,
+			Status:      args[2],
+			ValidUntil:  validUntil,
+		})
+	}
+
+	labAsBytes, _ = json.Marshal(laboratory)
+	APIstub.PutState(args[0], labAsBytes)
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["syncARMOwner", "BAYER"]}' labcc
+// Copies the ARM owner of the laboratory from the arm chaincode, which keeps the authoritative one:
+// a laboratory transfer accepted there does not update the owner stored here. Anyone may call it,
+// the owner is returned
+func (s *SmartContract) syncARMOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {LAB}")
+	}
+
+	laboratory, err := getLaboratory(APIstub, args[0], false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner, err := armOwner(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if laboratory.ARMOwner != owner {
+		laboratory.ARMOwner = owner
+		labAsBytes, _ := json.Marshal(laboratory)
+		APIstub.PutState(args[0], labAsBytes)
+	}
+
+	return shim.Success([]byte(owner))
+}
+
+// ./executeTransaction.sh '{"Args":["addLaboratory", "BAYER", "01/03/2018", "calle de BAYER", "OWNER01"]}' labcc
+func (s *SmartContract) addLaboratory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	createdDate, err := parseDate(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var lab = Laboratory{
+		DocType:                labDocType,
+		LaboratoryName:         args[0],
+		CreatedDate:            createdDate,
+		Address:                args[2],
+		ARMOwner:               args[3],
+		MarketingAuthorization: nil,
+		Pharmacy:               nil,
+	}
+
+	labAsBytes, _ := APIstub.GetState(args[0])
+	if len(labAsBytes) != 0 {
+		return shim.Error("Laboratory " + args[0] + " already exists")
+	}
+
+	labAsBytes, _ = json.Marshal(lab)
+	APIstub.PutState(args[0], labAsBytes)
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["migrateOrders", "A", "ZZZ"]}' labcc
+// Moves the orders embedded in the laboratories from START up to END (exclusive), as addMedicineOrder
+// stored them before the order index, under their own keys. Orders updated since keep their stored
+// version. Returns the names of the laboratories whose orders were moved
+func (s *SmartContract) migrateOrders(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {START, END}")
+	}
+
+	if len(args[0]) == 0 || len(args[1]) == 0 {
+		return shim.Error("Empty key. Expecting a START and an END")
+	}
+
+	resultsIterator, err := APIstub.GetStateByRange(args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	labs := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		labStruct := Laboratory{}
+		if err := json.Unmarshal(queryResponse.Value, &labStruct); err != nil {
+			return shim.Error("Key " + queryResponse.Key + " does not hold a laboratory")
+		}
+		if len(labStruct.Pharmacy) == 0 {
+			continue
+		}
+
+		for _, order := range labStruct.legacyOrders(queryResponse.Key) {
+			key, err := APIstub.CreateCompositeKey(orderIndex, []string{order.Laboratory, order.Pharmacy, order.ID})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			stored, err := APIstub.GetState(key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if len(stored) != 0 {
+				continue
+			}
+			if err := putOrder(APIstub, &order); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		labStruct.DocType = labDocType
+		labStruct.Pharmacy = nil
+		labAsBytes, _ := json.Marshal(labStruct)
+		if err := APIstub.PutState(queryResponse.Key, labAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		labs = append(labs, queryResponse.Key)
+	}
+
+	labsAsBytes, _ := json.Marshal(labs)
+	return shim.Success(labsAsBytes)
+}
+
+// ./executeTransaction.sh '{"Args":["queryByLab", "BAYER"]}' labcc
+func (s *SmartContract) queryByLab(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	labStruct, err := getLaboratory(APIstub, args[0], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	labAsBytes, _ := json.Marshal(labStruct)
+	return shim.Success(labAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryByLabWithPagination", "BAYER", "10", ""]}' labcc
+// The pharmacies of the lab hold one page of its orders, the bookmark fetches the next one
+func (s *SmartContract) queryByLabWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {LAB, PAGESIZE, BOOKMARK}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	labStruct, err := getLaboratory(APIstub, args[0], false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// orders still embedded in the lab are only paged once migrateOrders moves them
+	labStruct.Pharmacy = nil
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(orderIndex, []string{args[0]}, pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var orders []Order
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		order := Order{}
+		if err := json.Unmarshal(queryResponse.Value, &order); err != nil {
+			return shim.Error(err.Error())
+		}
+		orders = append(orders, order)
+	}
+	labStruct.addOrders(orders)
+
+	page := LabPage{Laboratory: *labStruct, FetchedRecordsCount: metadata.FetchedRecordsCount, Bookmark: metadata.Bookmark}
+	pageAsBytes, _ := json.Marshal(page)
+	return shim.Success(pageAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryBackorders", "BAYER", "FarmaciaAluche"]}' labcc
+// PHARMACY is optional, every backorder of the lab is returned when it is omitted
+func (s *SmartContract) queryBackorders(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	orders, err := getOrdersByPartialKey(APIstub, args...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	backorders := []Order{}
+	for _, order := range orders {
+		if order.Status == OrderPartiallySent {
+			backorders = append(backorders, order)
+		}
+	}
+
+	backordersAsBytes, _ := json.Marshal(backorders)
+	return shim.Success(backordersAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryLabsJSON", "BAYER", "laboratoryName", "authorizations.medicine", "pharmacy.order.status"]}' labcc
+// FIELDS are dotted JSON field paths of the Laboratory, named as in queryByLab. When they are omitted
+// the LaboratoryEntry summary of the lab master data is returned
+func (s *SmartContract) queryLabsJSON(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 1 {LAB, FIELDS...}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	fields := args[1:]
+	if len(fields) == 0 {
+		labStruct, err := getLaboratory(APIstub, args[0], false)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		entry := LaboratoryEntry{
+			LaboratoryName: labStruct.LaboratoryName,
+			CreatedDate:    labStruct.CreatedDate,
+			Address:        labStruct.Address,
+			ARMOwner:       labStruct.ARMOwner,
+		}
+		entryAsBytes, _ := json.Marshal(entry)
+		return shim.Success(entryAsBytes)
+	}
+
+	// orders are only read when a pharmacy field is requested
+	withOrders := false
+	paths := make([][]string, len(fields))
+	for i, field := range fields {
+		paths[i] = strings.Split(field, ".")
+		if err := checkFieldPath(reflect.TypeOf(Laboratory{}), paths[i]); err != nil {
+			return shim.Error(err.Error())
+		}
+		withOrders = withOrders || paths[i][0] == "pharmacy"
+	}
+
+	labStruct, err := getLaboratory(APIstub, args[0], withOrders)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// project the JSON form of the lab, so field names match the ones of queryByLab
+	labAsBytes, _ := json.Marshal(labStruct)
+	var labAsJSON interface{}
+	json.Unmarshal(labAsBytes, &labAsJSON)
+
+	projectionAsBytes, err := json.Marshal(project(labAsJSON, paths))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(projectionAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryLabByARM", "OWNER01"]}' labcc
+// Rich query, needs CouchDB as state database
+func (s *SmartContract) queryLabByARM(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an ARM owner")
+	}
+
+	queryString, err := selectorQuery(map[string]interface{}{"docType": labDocType, "armOwner": args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeQuery.sh '{"Args":["queryOrdersByStatus", "SENT", "BAYER"]}' labcc
+// LAB is optional, orders of every lab are returned when it is omitted. Rich query, needs CouchDB as state database
+func (s *SmartContract) queryOrdersByStatus(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	if !isOrderStatus(args[0]) {
+		return shim.Error("Invalid status " + args[0])
+	}
+
+	selector := map[string]interface{}{"docType": orderDocType, "status": args[0]}
+	if len(args) == 2 {
+		selector["laboratory"] = args[1]
+	}
+
+	queryString, err := selectorQuery(selector)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeQuery.sh '{"Args":["queryLabByARMWithPagination", "OWNER01", "10", ""]}' labcc
+// Rich query, needs CouchDB as state database
+func (s *SmartContract) queryLabByARMWithPagination(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {OWNER, PAGESIZE, BOOKMARK}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an ARM owner")
+	}
+
+	queryString, err := selectorQuery(map[string]interface{}{"docType": labDocType, "armOwner": args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeQuery.sh '{"Args":["queryOrdersByStatusWithPagination", "SENT", "10", "", "BAYER"]}' labcc
+// LAB is optional, orders of every lab are returned when it is omitted. Rich query, needs CouchDB as state database
+func (s *SmartContract) queryOrdersByStatusWithPagination(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4 {STATUS, PAGESIZE, BOOKMARK, LAB}")
+	}
+
+	if !isOrderStatus(args[0]) {
+		return shim.Error("Invalid status " + args[0])
+	}
+
+	selector := map[string]interface{}{"docType": orderDocType, "status": args[0]}
+	if len(args) == 4 {
+		selector["laboratory"] = args[3]
+	}
+
+	queryString, err := selectorQuery(selector)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeQuery.sh '{"Args":["queryBackordersWithPagination", "BAYER", "10", "", "FarmaciaAluche"]}' labcc
+// PHARMACY is optional, every backorder of the lab is returned when it is omitted. Rich query, needs CouchDB as state database
+func (s *SmartContract) queryBackordersWithPagination(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4 {LAB, PAGESIZE, BOOKMARK, PHARMACY}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	selector := map[string]interface{}{"docType": orderDocType, "laboratory": args[0], "status": OrderPartiallySent}
+	if len(args) == 4 {
+		selector["pharmacy"] = args[3]
+	}
+
+	queryString, err := selectorQuery(selector)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeQuery.sh '{"Args":["queryOrdersByLabWithPagination", "BAYER", "10", "", "FarmaciaAluche"]}' labcc
+// PHARMACY is optional, every order of the lab is returned when it is omitted
+func (s *SmartContract) queryOrdersByLabWithPagination(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4 {LAB, PAGESIZE, BOOKMARK, PHARMACY}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting a LAB")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	attributes := []string{args[0]}
+	if len(args) == 4 {
+		attributes = append(attributes, args[3])
+	}
+
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(orderIndex, attributes, pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructQueryPage(resultsIterator, metadata)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(queryResults)
 }
 
+// getLaboratory reads a laboratory, assembling its pharmacies from the lab orders when withOrders is set.
+// Orders still embedded in it are listed with the others unless one was updated since. Without
+// withOrders they are left embedded, as the laboratory may be written back
+func getLaboratory(stub shim.ChaincodeStubInterface, lab string, withOrders bool) (*Laboratory, error) {
+	labAsBytes, _ := stub.GetState(lab)
+	if len(labAsBytes) == 0 {
+		return nil, fmt.Errorf("Invalid key. Expecting a LAB")
+	}
+
+	labStruct := Laboratory{}
+	if err := json.Unmarshal(labAsBytes, &labStruct); err != nil {
+		return nil, err
+	}
+	if !withOrders {
+		return &labStruct, nil
+	}
+
+	orders, err := getOrdersByPartialKey(stub, lab)
+	if err != nil {
+		return nil, err
+	}
+	legacy := labStruct.legacyOrders(lab)
+	if len(legacy) > 0 {
+		stored := map[string]bool{}
+		for _, order := range orders {
+			stored[order.Pharmacy+"/"+order.ID] = true
+		}
+		for _, order := range legacy {
+			if !stored[order.Pharmacy+"/"+order.ID] {
+				orders = append(orders, order)
+			}
+		}
+		sort.SliceStable(orders, func(i, j int) bool { return orders[i].Pharmacy < orders[j].Pharmacy })
+	}
+	labStruct.Pharmacy = nil
+	labStruct.addOrders(orders)
+	return &labStruct, nil
+}
+
+// addOrders groups the orders under the pharmacies of the laboratory. Orders come back from
+// the lab~pharmacy~orderID index sorted by pharmacy, so each pharmacy is a contiguous run
+func (l *Laboratory) addOrders(orders []Order) {
+	for _, order := range orders {
+		last := len(l.Pharmacy) - 1
+		if last < 0 || l.Pharmacy[last].Pharmacy != order.Pharmacy {
+			l.Pharmacy = append(l.Pharmacy, Pharmacy{Pharmacy: order.Pharmacy})
+			last++
+		}
+		l.Pharmacy[last].Order = append(l.Pharmacy[last].Order, order)
+	}
+}
+
+// checkFieldPath fails unless path names nested JSON fields of the given type
+func checkFieldPath(t reflect.Type, path []string) error {
+	for i, name := range path {
+		for t.Kind() == reflect.Slice || t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return fmt.Errorf("Invalid field %s. %s has no nested fields", strings.Join(path, "."), strings.Join(path[:i], "."))
+		}
+
+		found := false
+		for j := 0; j < t.NumField(); j++ {
+			if strings.Split(t.Field(j).Tag.Get("json"), ",")[0] == name {
+				t = t.Field(j).Type
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Invalid field %s. Unknown field %s", strings.Join(path, "."), name)
+		}
+	}
+	return nil
+}
+
+// project keeps the given field paths of a decoded JSON value, applying them
+// to every element of arrays. A path ending at a field keeps the whole field
+func project(value interface{}, paths [][]string) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		projected := make([]interface{}, len(v))
+		for i, element := range v {
+			projected[i] = project(element, paths)
+		}
+		return projected
+	case map[string]interface{}:
+		nested := map[string][][]string{}
+		whole := map[string]bool{}
+		for _, path := range paths {
+			if len(path) == 1 {
+				whole[path[0]] = true
+			} else {
+				nested[path[0]] = append(nested[path[0]], path[1:])
+			}
+		}
+
+		projected := map[string]interface{}{}
+		for name, field := range v {
+			if whole[name] {
+				projected[name] = field
+			} else if fieldPaths, ok := nested[name]; ok {
+				projected[name] = project(field, fieldPaths)
+			}
+		}
+		return projected
+	}
+	return value
+}
+
+// getOrder reads the order stored under lab~pharmacy~orderID, returning nil when it does not exist.
+// A LEGACY order not yet stored there is read from the laboratory it is embedded in
+func getOrder(stub shim.ChaincodeStubInterface, lab string, pharmacy string, orderID string) (*Order, []byte, error) {
+	key, err := stub.CreateCompositeKey(orderIndex, []string{lab, pharmacy, orderID})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	orderAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get order %s: %s", orderID, err.Error())
+	}
+	if len(orderAsBytes) == 0 {
+		if !strings.HasPrefix(orderID, legacyOrderPrefix) {
+			return nil, nil, nil
+		}
+		return getLegacyOrder(stub, lab, pharmacy, orderID)
+	}
+
+	order := Order{}
+	if err := json.Unmarshal(orderAsBytes, &order); err != nil {
+		return nil, nil, err
+	}
+	return &order, orderAsBytes, nil
+}
+
+// getLegacyOrder reads an order still embedded in the laboratory, returning nil when there is none
+func getLegacyOrder(stub shim.ChaincodeStubInterface, lab string, pharmacy string, orderID string) (*Order, []byte, error) {
+	labAsBytes, err := stub.GetState(lab)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get laboratory %s: %s", lab, err.Error())
+	}
+	if len(labAsBytes) == 0 {
+		return nil, nil, nil
+	}
+
+	labStruct := Laboratory{}
+	if err := json.Unmarshal(labAsBytes, &labStruct); err != nil {
+		return nil, nil, err
+	}
+	for _, order := range labStruct.legacyOrders(lab) {
+		if order.Pharmacy == pharmacy && order.ID == orderID {
+			orderAsBytes, _ := json.Marshal(order)
+			return &order, orderAsBytes, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// putOrder stores the order under lab~pharmacy~orderID
+func putOrder(stub shim.ChaincodeStubInterface, order *Order) error {
+	key, err := stub.CreateCompositeKey(orderIndex, []string{order.Laboratory, order.Pharmacy, order.ID})
+	if err != nil {
+		return err
+	}
+
+	order.DocType = orderDocType
+	orderAsBytes, _ := json.Marshal(order)
+	return stub.PutState(key, orderAsBytes)
+}
+
+// emitOrderEvent sets the chaincode event matching the current status of the order.
+// Fabric keeps a single event per transaction, so it must be called once, after the
+// order has been stored
+func emitOrderEvent(stub shim.ChaincodeStubInterface, order *Order, shipped int64, date string) error {
+	event := OrderEvent{
+		OrderID:     order.ID,
+		Laboratory:  order.Laboratory,
+		Pharmacy:    order.Pharmacy,
+		Medicine:    order.Name,
+		Quantity:    order.Quantity,
+		Shipped:     shipped,
+		Outstanding: order.Outstanding,
+		Status:      order.Status,
+		Reason:      order.RejectReason,
+		Date:        date,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(orderEvents[order.Status], payload)
+}
+
+// txDate returns the transaction timestamp as an RFC 3339 UTC date, so every
+// endorsing peer computes the same value
+func txDate(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+// dateLayouts are tried in order on caller supplied dates
+var dateLayouts = []string{time.RFC3339, "02/01/2006"}
+
+// parseDate validates a caller supplied date, given either as RFC 3339 or as
+// dd/mm/yyyy, and normalizes it to RFC 3339 UTC
+func parseDate(value string) (string, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid date %s. Expecting RFC 3339 or dd/mm/yyyy", value)
+}
+
+// getOrdersByPartialKey returns the orders whose key starts with the given lab and, optionally, pharmacy
+func getOrdersByPartialKey(stub shim.ChaincodeStubInterface, attributes ...string) ([]Order, error) {
+	ordersIterator, err := stub.GetStateByPartialCompositeKey(orderIndex, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer ordersIterator.Close()
+
+	var orders []Order
+	for ordersIterator.HasNext() {
+		queryResponse, err := ordersIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		order := Order{}
+		if err := json.Unmarshal(queryResponse.Value, &order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// checkMedicine fails unless the medicine code is in the registry of the arm chaincode
+func checkMedicine(stub shim.ChaincodeStubInterface, code string) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+
+	response := stub.InvokeChaincode(config.ARMChaincode, toChaincodeArgs("queryMedicine", code), config.ARMChannel)
+	if response.Status != shim.OK {
+		return fmt.Errorf("Failed to invoke armcc. Got error: %s", response.Message)
+	}
+	return nil
+}
+
+// armOwner asks the arm chaincode which ARM the laboratory belongs to
+func armOwner(stub shim.ChaincodeStubInterface, lab string) (string, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+
+	response := stub.InvokeChaincode(config.ARMChaincode, toChaincodeArgs("queryLaboratoryOwners", lab), config.ARMChannel)
+	if response.Status != shim.OK {
+		return "", fmt.Errorf("Failed to invoke armcc. Got error: %s", response.Message)
+	}
+
+	var owners []string
+	if err := json.Unmarshal(response.Payload, &owners); err != nil {
+		return "", err
+	}
+	if len(owners) != 1 {
+		return "", fmt.Errorf("Laboratory %s belongs to %d ARMs in the arm chaincode. Expecting 1", lab, len(owners))
+	}
+	return owners[0], nil
+}
+
+// getConfig reads the chaincode configuration, falling back to the defaults
+// when the chaincode was upgraded from a version without one
+func getConfig(stub shim.ChaincodeStubInterface) (*Config, error) {
+	key, err := stub.CreateCompositeKey(configIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig
+	configAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(configAsBytes) != 0 {
+		if err := json.Unmarshal(configAsBytes, &config); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// putConfig stores the chaincode configuration
+func putConfig(stub shim.ChaincodeStubInterface, config *Config) error {
+	key, err := stub.CreateCompositeKey(configIndex, []string{})
+	if err != nil {
+		return err
+	}
+
+	config.DocType = configDocType
+	configAsBytes, _ := json.Marshal(config)
+	return stub.PutState(key, configAsBytes)
+}
+
+// getBatches returns the batches whose key starts with the given lab and, optionally, medicine
+func getBatches(stub shim.ChaincodeStubInterface, attributes ...string) ([]Batch, error) {
+	batchesIterator, err := stub.GetStateByPartialCompositeKey(batchIndex, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer batchesIterator.Close()
+
+	var batches []Batch
+	for batchesIterator.HasNext() {
+		queryResponse, err := batchesIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		batch := Batch{}
+		if err := json.Unmarshal(queryResponse.Value, &batch); err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// putBatch stores the batch under lab~medicine~lot
+func putBatch(stub shim.ChaincodeStubInterface, batch *Batch) error {
+	key, err := stub.CreateCompositeKey(batchIndex, []string{batch.Laboratory, batch.Medicine, batch.Lot})
+	if err != nil {
+		return err
+	}
+
+	batch.DocType = batchDocType
+	batchAsBytes, _ := json.Marshal(batch)
+	return stub.PutState(key, batchAsBytes)
+}
+
+// getStock reads the reservations of a medicine, returning an empty Stock when there are none
+func getStock(stub shim.ChaincodeStubInterface, lab string, medicine string) (*Stock, error) {
+	key, err := stub.CreateCompositeKey(stockIndex, []string{lab, medicine})
+	if err != nil {
+		return nil, err
+	}
+
+	stock := Stock{Laboratory: lab, Medicine: medicine}
+	stockAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(stockAsBytes) != 0 {
+		if err := json.Unmarshal(stockAsBytes, &stock); err != nil {
+			return nil, err
+		}
+	}
+	return &stock, nil
+}
+
+// summarizeStock works out the stock position of each medicine the batches belong to at the given date.
+// Batches come back from getBatches sorted by medicine, so each medicine is a contiguous run
+func summarizeStock(stub shim.ChaincodeStubInterface, batches []Batch, date string) ([]StockSummary, error) {
+	summaries := []StockSummary{}
+	for _, batch := range batches {
+		last := len(summaries) - 1
+		if last < 0 || summaries[last].Medicine != batch.Medicine {
+			stock, err := getStock(stub, batch.Laboratory, batch.Medicine)
+			if err != nil {
+				return nil, err
+			}
+			summaries = append(summaries, StockSummary{
+				Laboratory: batch.Laboratory,
+				Medicine:   batch.Medicine,
+				Reserved:   stock.Reserved,
+				Available:  -stock.Reserved,
+			})
+			last++
+		}
+
+		summary := &summaries[last]
+		if batch.isExpired(date) {
+			summary.Expired += batch.Available
+		} else {
+			summary.OnHand += batch.Available
+			summary.Available += batch.Available
+		}
+		summary.Batches = append(summary.Batches, batch)
+	}
+	return summaries, nil
+}
+
+// putStock stores the reservations of a medicine under lab~medicine
+func putStock(stub shim.ChaincodeStubInterface, stock *Stock) error {
+	key, err := stub.CreateCompositeKey(stockIndex, []string{stock.Laboratory, stock.Medicine})
+	if err != nil {
+		return err
+	}
+
+	stock.DocType = stockDocType
+	stockAsBytes, _ := json.Marshal(stock)
+	return stub.PutState(key, stockAsBytes)
+}
+
+// reserveStock reserves the quantity of a medicine, failing when the unexpired
+// units not yet reserved for other orders do not cover it
+func reserveStock(stub shim.ChaincodeStubInterface, lab string, medicine string, quantity int64, date string) error {
+	batches, err := getBatches(stub, lab, medicine)
+	if err != nil {
+		return err
+	}
+	stock, err := getStock(stub, lab, medicine)
+	if err != nil {
+		return err
+	}
+
+	available := -stock.Reserved
+	for _, batch := range batches {
+		if !batch.isExpired(date) {
+			available += batch.Available
+		}
+	}
+	if available < quantity {
+		return fmt.Errorf("Insufficient stock of %s: %d available, %d requested", medicine, available, quantity)
+	}
+
+	stock.Reserved += quantity
+	return putStock(stub, stock)
+}
+
+// releaseStock gives back a reservation made by reserveStock
+func releaseStock(stub shim.ChaincodeStubInterface, lab string, medicine string, quantity int64) error {
+	stock, err := getStock(stub, lab, medicine)
+	if err != nil {
+		return err
+	}
+
+	stock.Reserved -= quantity
+	if stock.Reserved < 0 {
+		stock.Reserved = 0
+	}
+	return putStock(stub, stock)
+}
+
+// allocateLots takes the quantity from the unexpired lots of a medicine, first
+// expiry first out, and consumes the matching reservation
+func allocateLots(stub shim.ChaincodeStubInterface, lab string, medicine string, quantity int64, date string) ([]LotAllocation, error) {
+	batches, err := getBatches(stub, lab, medicine)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(batches, func(i, j int) bool {
+		return batches[i].ExpiryDate < batches[j].ExpiryDate
+	})
+
+	var lots []LotAllocation
+	remaining := quantity
+	for i := range batches {
+		batch := &batches[i]
+		if remaining == 0 {
+			break
+		}
+		if batch.Available == 0 || batch.isExpired(date) {
+			continue
+		}
+
+		taken := batch.Available
+		if taken > remaining {
+			taken = remaining
+		}
+		batch.Available -= taken
+		remaining -= taken
+
+		if err := putBatch(stub, batch); err != nil {
+			return nil, err
+		}
+		lots = append(lots, LotAllocation{Lot: batch.Lot, ExpiryDate: batch.ExpiryDate, Quantity: taken})
+	}
+	if remaining > 0 {
+		return nil, fmt.Errorf("Insufficient stock of %s: %d units missing to send %d", medicine, remaining, quantity)
+	}
+
+	return lots, releaseStock(stub, lab, medicine, quantity)
+}
+
+// checkRegulator fails unless the invoking client is a regulator
+func checkRegulator(stub shim.ChaincodeStubInterface) error {
+	role, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return fmt.Errorf("Failed to read client identity: %s", err.Error())
+	}
+	if !found || role != regulatorRole {
+		return fmt.Errorf("Permission denied: the client is not a regulator")
+	}
+	return nil
+}
+
 func toChaincodeArgs(args ...string) [][]byte {
 	bargs := make([][]byte, len(args))
 	for i, arg := range args {
@@ -349,9 +2006,16 @@ func toChaincodeArgs(args ...string) [][]byte {
 	return bargs
 }
 
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+// selectorQuery builds a CouchDB query string matching every field of the selector
+func selectorQuery(selector map[string]interface{}) (string, error) {
+	queryAsBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
 
-	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
 
 	resultsIterator, err := stub.GetQueryResult(queryString)
 	if err != nil {
@@ -373,10 +2037,10 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
 		}
+		// Keys may be composite keys, so they are escaped
+		keyAsBytes, _ := json.Marshal(queryResponse.Key)
 		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+		buffer.Write(keyAsBytes)
 
 		buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
@@ -386,11 +2050,52 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
-
 	return buffer.Bytes(), nil
 }
 
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize string, bookmark string) ([]byte, error) {
+	size, err := parsePageSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(queryString, size, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	return constructQueryPage(resultsIterator, metadata)
+}
+
+// parsePageSize validates the PAGESIZE argument of paginated queries
+func parsePageSize(pageSize string) (int32, error) {
+	size, err := strconv.ParseInt(pageSize, 10, 32)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid page size %s. Expecting a positive integer", pageSize)
+	}
+	return int32(size), nil
+}
+
+// constructQueryPage reads a page of results into a QueryPage along with the bookmark of the next page
+func constructQueryPage(resultsIterator shim.StateQueryIteratorInterface, metadata *sc.QueryResponseMetadata) ([]byte, error) {
+	page := QueryPage{Records: []QueryRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		page.Records = append(page.Records, QueryRecord{Key: queryResponse.Key, Record: queryResponse.Value})
+	}
+
+	if metadata != nil {
+		page.FetchedRecordsCount = metadata.FetchedRecordsCount
+		page.Bookmark = metadata.Bookmark
+	}
+
+	return json.Marshal(page)
+}
+
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
 
@@ -1,13 +1,132 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
+// signedStub answers GetCreator, which MockStub leaves empty, and pages through
+// composite keys, which MockStub does not do either
+type signedStub struct {
+	*shim.MockStub
+	creator []byte
+}
+
+func (s signedStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination returns pageSize keys from the bookmark on,
+// the bookmark of the next page being its first key as it is on a peer
+func (s signedStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	startKey, err := s.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	endKey := startKey + "\U0010FFFF"
+	if bookmark != "" {
+		startKey = bookmark
+	}
+
+	metadata := &sc.QueryResponseMetadata{}
+	keysIterator := shim.NewMockStateRangeQueryIterator(s.MockStub, startKey, endKey)
+	for keysIterator.HasNext() {
+		queryResponse, _ := keysIterator.Next()
+		if metadata.FetchedRecordsCount == pageSize {
+			metadata.Bookmark = queryResponse.Key
+			endKey = queryResponse.Key
+			break
+		}
+		metadata.FetchedRecordsCount++
+	}
+	return shim.NewMockStateRangeQueryIterator(s.MockStub, startKey, endKey), metadata, nil
+}
+
+// signedLab runs the lab chaincode as the client whose serialized identity is in creator
+type signedLab struct {
+	SmartContract
+	creator []byte
+}
+
+func (l *signedLab) Init(stub shim.ChaincodeStubInterface) sc.Response {
+	return l.SmartContract.Init(signedStub{stub.(*shim.MockStub), l.creator})
+}
+
+func (l *signedLab) Invoke(stub shim.ChaincodeStubInterface) sc.Response {
+	return l.SmartContract.Invoke(signedStub{stub.(*shim.MockStub), l.creator})
+}
+
+// identity returns the serialized identity of a Org1MSP client named cn, whose self
+// signed certificate holds the given role attribute unless role is empty
+func identity(t *testing.T, cn string, role string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if role != "" {
+		value, _ := json.Marshal(map[string]interface{}{"attrs": map[string]string{"role": role}})
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: []int{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: value})
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, _ := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	return creator
+}
+
+// armChaincode stands in for the arm chaincode in cross chaincode invocations
+type armChaincode struct {
+	invocations [][]string
+}
+
+func (a *armChaincode) Init(stub shim.ChaincodeStubInterface) sc.Response {
+	return shim.Success(nil)
+}
+
+func (a *armChaincode) Invoke(stub shim.ChaincodeStubInterface) sc.Response {
+	function, args := stub.GetFunctionAndParameters()
+	a.invocations = append(a.invocations, append([]string{function}, args...))
+	if function == "queryLaboratoryOwners" {
+		owners := map[string]string{"BAYER": "[\"OWNER2\"]", "ROCHE": "[\"OWNER1\",\"OWNER2\"]"}[args[0]]
+		if owners == "" {
+			owners = "[]"
+		}
+		return shim.Success([]byte(owners))
+	}
+	if function == "queryMedicine" {
+		if args[0] != "IBUPROFENO" && args[0] != "ASPIRINA" {
+			return shim.Error("Medicine " + args[0] + " is not registered")
+		}
+		return shim.Success([]byte("{\"code\":\"" + args[0] + "\"}"))
+	}
+	if args[0] != "OWNER1" {
+		return shim.Error("Failed to get specified ARM")
+	}
+	return shim.Success(nil)
+}
+
 ////////////////// Util Methods //////////////////
 
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
@@ -50,6 +169,20 @@ func checkQuery(t *testing.T, stub *shim.MockStub, tx string, name string, value
 	}
 }
 
+func checkQueryArgs(t *testing.T, stub *shim.MockStub, args [][]byte, values ...string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Query", string(args[0]), "failed", string(res.Message))
+		t.FailNow()
+	}
+	for _, v := range values {
+		if !strings.Contains(string(res.Payload), v) {
+			fmt.Println("Query value", string(res.Payload), "was not", v, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
 func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInvoke("1", args)
 	if res.Status != shim.OK {
@@ -58,6 +191,40 @@ func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	}
 }
 
+func checkInvokeWithTxID(t *testing.T, stub *shim.MockStub, txID string, args [][]byte) []byte {
+	res := stub.MockInvoke(txID, args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	return res.Payload
+}
+
+func checkEvent(t *testing.T, stub *shim.MockStub, name string, values ...string) {
+	if len(stub.ChaincodeEventsChannel) == 0 {
+		fmt.Println("Event", name, "failed to get value")
+		t.FailNow()
+	}
+	event := <-stub.ChaincodeEventsChannel
+	if event.EventName != name {
+		fmt.Println("Event", event.EventName, "was not", name, "as expected")
+		t.FailNow()
+	}
+	for _, v := range values {
+		if !strings.Contains(string(event.Payload), v) {
+			fmt.Println("Event value", name, "was not", v, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+func checkNoEvent(t *testing.T, stub *shim.MockStub) {
+	if len(stub.ChaincodeEventsChannel) != 0 {
+		fmt.Println("Event", (<-stub.ChaincodeEventsChannel).EventName, "was not expected")
+		t.FailNow()
+	}
+}
+
 func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInvoke("1", args)
 	if res.Status != shim.ERROR {
@@ -66,6 +233,33 @@ func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	}
 }
 
+// newLab returns a lab stub whose client is a regulator and whose arm chaincode is the armChaincode fake
+func newLab(t *testing.T) (*shim.MockStub, *armChaincode) {
+	arm := new(armChaincode)
+	stub := shim.NewMockStub("ex01", &signedLab{creator: identity(t, "regulator1", "regulator")})
+	stub.MockPeerChaincode("arm/mychannel", shim.NewMockStub("arm", arm))
+	return stub, arm
+}
+
+// authorize grants the laboratory of OWNER1 an ACTIVE authorization for each medicine the way
+// the arm chaincode does: the laboratory requests it and the regulator's approval activates it
+func authorize(t *testing.T, stub *shim.MockStub, lab string, medicines ...string) {
+	for _, medicine := range medicines {
+		checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte(lab), []byte(medicine), []byte("01/07/2018")})
+		checkEvent(t, stub, EventAuthorizationSubmitted)
+		checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte(lab), []byte(medicine), []byte("ACTIVE")})
+	}
+}
+
+// authorizedLab returns a lab stub holding the laboratory BAYER of OWNER1, authorized to sell the medicines
+func authorizedLab(t *testing.T, medicines ...string) (*shim.MockStub, *armChaincode) {
+	stub, arm := newLab(t)
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("BAYER"), []byte("15/03/2018"), []byte("1st Street"), []byte("OWNER1")})
+	authorize(t, stub, "BAYER", medicines...)
+	arm.invocations = nil
+	return stub, arm
+}
+
 ////////////////// Tests //////////////////
 
 func Test_givenANewLaboratoryWhenAddLaboratoryThenLaboratoryIsPersisted(t *testing.T) {
@@ -75,7 +269,24 @@ func Test_givenANewLaboratoryWhenAddLaboratoryThenLaboratoryIsPersisted(t *testi
 	// addLaboratory LabXXX, 15/03/2018, 1st Street, ARM
 	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("LabXXX"), []byte("15/03/2018"), []byte("1st Street"), []byte("ARM")})
 
-	checkState(t, stub, "LabXXX", "address", "1st Street", "armOwner", "ARM")
+	checkState(t, stub, "LabXXX", "\"docType\":\"lab\"", "address", "1st Street", "armOwner", "ARM", "2018-03-15T00:00:00Z")
+}
+
+func Test_givenAnExistingLaboratoryWhenAddLaboratoryThenError(t *testing.T) {
+	scc := new(SmartContract)
+	stub := shim.NewMockStub("ex01", scc)
+
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("LabXXX"), []byte("15/03/2018"), []byte("1st Street"), []byte("ARM")})
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("LabXXX"), []byte("16/03/2018"), []byte("2nd Street"), []byte("ARM")})
+
+	checkState(t, stub, "LabXXX", "1st Street")
+}
+
+func Test_givenANewLaboratoryWhenAddLaboratoryWithInvalidDateThenError(t *testing.T) {
+	scc := new(SmartContract)
+	stub := shim.NewMockStub("ex01", scc)
+
+	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("LabXXX"), []byte("yesterday"), []byte("1st Street"), []byte("ARM")})
 }
 
 func Test_givenANewLaboratoryWhenAddLaboratoryWithOneParamThenError(t *testing.T) {
@@ -86,3 +297,642 @@ func Test_givenANewLaboratoryWhenAddLaboratoryWithOneParamThenError(t *testing.T
 	checkInvokeError(t, stub, [][]byte{[]byte("addLaboratory"), []byte("LabXXX")})
 
 }
+
+func Test_givenTwoIdenticalOrdersWhenAddMedicineOrderThenEachOrderGetsItsOwnID(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("100")})
+
+	order := [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")}
+	first := checkInvokeWithTxID(t, stub, "tx1", order)
+	second := checkInvokeWithTxID(t, stub, "tx2", order)
+	if string(first) != "tx1" || string(second) != "tx2" {
+		fmt.Println("Unexpected order IDs", string(first), string(second))
+		t.FailNow()
+	}
+
+	// the same transaction cannot allocate the same ID twice
+	res := stub.MockInvoke("tx1", order)
+	if res.Status != shim.ERROR {
+		fmt.Println("Invoke", order, "success", string(res.Message))
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, [][]byte{[]byte("acknowledgeOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), second})
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first}, "\"status\":\"CREATED\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), second}, "\"status\":\"ACKNOWLEDGED\"")
+}
+
+func Test_givenOrdersFromSeveralPharmaciesWhenQueryByLabThenOrdersAreGroupedByPharmacy(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO", "ASPIRINA")
+	checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	checkInvokeWithTxID(t, stub, "tx2", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaSol"), []byte("ASPIRINA"), []byte("ASPIRINADESC"), []byte("3")})
+
+	// orders never touch the laboratory document
+	checkState(t, stub, "BAYER", "1st Street")
+	if strings.Contains(string(stub.State["BAYER"]), "FarmaciaAluche") {
+		fmt.Println("State value BAYER contains orders")
+		t.FailNow()
+	}
+
+	checkQuery(t, stub, "queryByLab", "BAYER", "\"pharmacy\":\"FarmaciaAluche\"", "IBUPROFENO", "\"pharmacy\":\"FarmaciaSol\"", "ASPIRINA")
+
+	// orders cannot be placed with unknown laboratories
+	checkInvokeError(t, stub, [][]byte{[]byte("addMedicineOrder"), []byte("GLX"), []byte("FarmaciaSol"), []byte("ASPIRINA"), []byte("ASPIRINADESC"), []byte("3")})
+}
+
+func Test_givenOrdersEmbeddedInTheLaboratoryWhenMigrateOrdersThenTheyAreStoredUnderTheirOwnKeys(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+
+	// orders as addMedicineOrder embedded them in the laboratory before the order index
+	stub.MockTransactionStart("legacy")
+	stub.PutState("GLX", []byte(`{"laboratoryName":"GLX","createdDate":"01/03/2018","address":"2nd Street","armOwner":"OWNER1","pharmacy":[`+
+		`{"pharmacy":"FarmaciaAluche","order":[{"name":"IBUPROFENO","desc":"IBUPROFENODESC","quantity":7,"datecreated":"01/03/2018","datesent":"02/03/2018","sentflag":"true"},`+
+		`{"name":"ASPIRINA","desc":"ASPIRINADESC","quantity":3,"datecreated":"03/03/2018"}]}]}`))
+	stub.MockTransactionEnd("legacy")
+
+	checkQuery(t, stub, "queryByLab", "GLX", "\"id\":\"LEGACY1\"", "\"status\":\"SENT\"", "\"id\":\"LEGACY2\"", "\"status\":\"CREATED\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryOrder"), []byte("GLX"), []byte("FarmaciaAluche"), []byte("LEGACY1")}, "\"outstanding\":0", "\"datesent\":\"02/03/2018\"")
+
+	// an embedded order can be updated before it is moved, and the update wins
+	checkInvoke(t, stub, [][]byte{[]byte("cancelOrder"), []byte("GLX"), []byte("FarmaciaAluche"), []byte("LEGACY2")})
+	res := stub.MockInvoke("1", [][]byte{[]byte("queryByLab"), []byte("GLX")})
+	if strings.Count(string(res.Payload), "\"id\":\"LEGACY2\"") != 1 || !strings.Contains(string(res.Payload), "\"status\":\"CANCELLED\"") {
+		fmt.Println("Unexpected lab", string(res.Payload))
+		t.FailNow()
+	}
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("migrateOrders"), []byte("A"), []byte("ZZZ")}, "[\"GLX\"]")
+	checkQueryArgs(t, stub, [][]byte{[]byte("migrateOrders"), []byte("A"), []byte("ZZZ")}, "[]")
+
+	checkState(t, stub, "GLX", "\"docType\":\"lab\"", "2nd Street")
+	if strings.Contains(string(stub.State["GLX"]), "FarmaciaAluche") {
+		fmt.Println("State value GLX contains orders")
+		t.FailNow()
+	}
+	sent, _ := stub.CreateCompositeKey(orderIndex, []string{"GLX", "FarmaciaAluche", "LEGACY1"})
+	cancelled, _ := stub.CreateCompositeKey(orderIndex, []string{"GLX", "FarmaciaAluche", "LEGACY2"})
+	checkState(t, stub, sent, "\"status\":\"SENT\"", "\"laboratory\":\"GLX\"")
+	checkState(t, stub, cancelled, "\"status\":\"CANCELLED\"")
+	checkQuery(t, stub, "queryByLab", "GLX", "LEGACY1", "LEGACY2")
+}
+
+func Test_givenALaboratoryWithOrdersWhenQueryLabsJSONThenSelectedFieldsAreValidJSON(t *testing.T) {
+	stub, _ := newLab(t)
+
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("BAYER"), []byte("15/03/2018"), []byte("1st \"Street\""), []byte("OWNER1")})
+	authorize(t, stub, "BAYER", "IBUPROFENO")
+	checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("queryLabsJSON"), []byte("BAYER")})
+	var summary map[string]interface{}
+	if res.Status != shim.OK || json.Unmarshal(res.Payload, &summary) != nil {
+		fmt.Println("queryLabsJSON BAYER failed", string(res.Message), string(res.Payload))
+		t.FailNow()
+	}
+	if summary["Address"] != "1st \"Street\"" || summary["LaboratoryName"] != "BAYER" || summary["ARMOwner"] != "OWNER1" || len(summary) != 4 {
+		fmt.Println("queryLabsJSON BAYER returned", string(res.Payload))
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", [][]byte{[]byte("queryLabsJSON"), []byte("BAYER"), []byte("laboratoryName"), []byte("pharmacy.order.name"), []byte("pharmacy.order.status")})
+	var projection struct {
+		LaboratoryName string
+		Address        string
+		Pharmacy       []struct {
+			Pharmacy string
+			Order    []map[string]interface{}
+		}
+	}
+	if res.Status != shim.OK || json.Unmarshal(res.Payload, &projection) != nil {
+		fmt.Println("queryLabsJSON BAYER pharmacy.order failed", string(res.Message), string(res.Payload))
+		t.FailNow()
+	}
+	if projection.LaboratoryName != "BAYER" || projection.Address != "" || len(projection.Pharmacy) != 1 || projection.Pharmacy[0].Pharmacy != "" {
+		fmt.Println("queryLabsJSON BAYER pharmacy.order returned", string(res.Payload))
+		t.FailNow()
+	}
+	if order := projection.Pharmacy[0].Order; len(order) != 1 || len(order[0]) != 2 || order[0]["name"] != "IBUPROFENO" || order[0]["status"] != "CREATED" {
+		fmt.Println("queryLabsJSON BAYER pharmacy.order returned", string(res.Payload))
+		t.FailNow()
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("queryLabsJSON"), []byte("BAYER"), []byte("pharmacy.order.color")})
+	checkInvokeError(t, stub, [][]byte{[]byte("queryLabsJSON"), []byte("BAYER"), []byte("address.street")})
+	checkInvokeError(t, stub, [][]byte{[]byte("queryLabsJSON"), []byte("GLX")})
+}
+
+func Test_givenAnAcknowledgedOrderWhenSendAndConfirmArrivalThenOrderIsArrived(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("100")})
+	orderID := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	order := [][]byte{[]byte("BAYER"), []byte("FarmaciaAluche"), orderID}
+	checkQueryArgs(t, stub, append([][]byte{[]byte("queryOrder")}, order...), "\"status\":\"CREATED\"")
+
+	// an order must be acknowledged before it is sent
+	checkInvokeError(t, stub, append([][]byte{[]byte("SendOrder")}, order...))
+
+	checkInvoke(t, stub, append([][]byte{[]byte("acknowledgeOrder")}, order...))
+	checkInvoke(t, stub, append([][]byte{[]byte("SendOrder")}, order...))
+	checkQueryArgs(t, stub, append([][]byte{[]byte("queryOrder")}, order...), "\"status\":\"SENT\"")
+
+	// a sent order can no longer be cancelled
+	checkInvokeError(t, stub, append([][]byte{[]byte("cancelOrder")}, order...))
+
+	checkInvoke(t, stub, append([][]byte{[]byte("confirmOrderArrival")}, order...))
+	checkQueryArgs(t, stub, append([][]byte{[]byte("queryOrder")}, order...), "\"status\":\"ARRIVED\"")
+}
+
+func Test_givenACreatedOrderWhenRejectOrderThenOrderIsClosed(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	orderID := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+
+	order := [][]byte{[]byte("BAYER"), []byte("FarmaciaAluche"), orderID}
+
+	checkInvoke(t, stub, append(append([][]byte{[]byte("rejectOrder")}, order...), []byte("Out of stock")))
+	checkQueryArgs(t, stub, append([][]byte{[]byte("queryOrder")}, order...), "\"status\":\"REJECTED\"", "Out of stock")
+
+	// a rejected order cannot be cancelled
+	checkInvokeError(t, stub, append([][]byte{[]byte("cancelOrder")}, order...))
+
+	// unknown orders are reported
+	checkInvokeError(t, stub, [][]byte{[]byte("cancelOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("tx2")})
+}
+
+func Test_givenAnAcknowledgedOrderWhenSendPartOfItThenRestIsBackordered(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO", "ASPIRINA")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("100")})
+	orderID := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	checkInvokeWithTxID(t, stub, "tx2", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaSol"), []byte("ASPIRINA"), []byte("ASPIRINADESC"), []byte("3")})
+
+	order := [][]byte{[]byte("BAYER"), []byte("FarmaciaAluche"), orderID}
+	checkInvoke(t, stub, append([][]byte{[]byte("acknowledgeOrder")}, order...))
+
+	// more than the outstanding quantity cannot be sent
+	checkInvokeError(t, stub, append(append([][]byte{[]byte("SendOrder")}, order...), []byte("8")))
+
+	checkInvoke(t, stub, append(append([][]byte{[]byte("SendOrder")}, order...), []byte("5")))
+	checkQueryArgs(t, stub, append([][]byte{[]byte("queryOrder")}, order...), "\"status\":\"PARTIALLY_SENT\"", "\"outstanding\":2")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryBackorders"), []byte("BAYER")}, "tx1", "\"outstanding\":2")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryBackorders"), []byte("BAYER"), []byte("FarmaciaAluche")}, "tx1")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryBackorders"), []byte("BAYER"), []byte("FarmaciaSol")}, "[]")
+
+	checkInvoke(t, stub, append([][]byte{[]byte("SendOrder")}, order...))
+	checkQueryArgs(t, stub, append([][]byte{[]byte("queryOrder")}, order...), "\"status\":\"SENT\"", "\"outstanding\":0", "\"quantity\":5", "\"quantity\":2")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryBackorders"), []byte("BAYER")}, "[]")
+
+	checkInvokeError(t, stub, append(append([][]byte{[]byte("SendOrder")}, order...), []byte("1")))
+}
+
+func Test_givenSeveralLotsWhenSendOrderThenLotsAreAllocatedFirstExpiryFirstOut(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L-LATE"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("10")})
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L-EARLY"), []byte("01/03/2018"), []byte("01/03/2098"), []byte("4")})
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L-EXPIRED"), []byte("01/03/2015"), []byte("01/03/2018"), []byte("50")})
+
+	// lots cannot be registered twice
+	checkInvokeError(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L-LATE"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("10")})
+
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"onHand\":14", "\"expired\":50", "\"available\":14")
+
+	first := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("6")})
+	second := checkInvokeWithTxID(t, stub, "tx2", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaSol"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("9")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("acknowledgeOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER")}, "\"reserved\":6", "\"available\":8")
+
+	// expired units cannot be reserved
+	checkInvokeError(t, stub, [][]byte{[]byte("acknowledgeOrder"), []byte("BAYER"), []byte("FarmaciaSol"), second})
+
+	checkInvoke(t, stub, [][]byte{[]byte("SendOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first},
+		"{\"lot\":\"L-EARLY\",\"expiryDate\":\"2098-03-01T00:00:00Z\",\"quantity\":4}",
+		"{\"lot\":\"L-LATE\",\"expiryDate\":\"2099-03-01T00:00:00Z\",\"quantity\":2}")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"onHand\":8", "\"reserved\":0", "\"available\":8")
+}
+
+func Test_givenAnAcknowledgedOrderWhenCancelOrderThenReservationIsReleased(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("10")})
+	orderID := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("acknowledgeOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), orderID})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"reserved\":7", "\"available\":3")
+
+	checkInvoke(t, stub, [][]byte{[]byte("cancelOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), orderID})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"reserved\":0", "\"available\":10")
+}
+
+func Test_givenABackorderWhenCancelOrRejectOrderThenUnsentUnitsAreReleased(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("20")})
+	first := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	second := checkInvokeWithTxID(t, stub, "tx2", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaSol"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("6")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("acknowledgeOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first})
+	checkInvoke(t, stub, [][]byte{[]byte("acknowledgeOrder"), []byte("BAYER"), []byte("FarmaciaSol"), second})
+	checkInvoke(t, stub, [][]byte{[]byte("SendOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first, []byte("5")})
+	checkInvoke(t, stub, [][]byte{[]byte("SendOrder"), []byte("BAYER"), []byte("FarmaciaSol"), second, []byte("2")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"onHand\":13", "\"reserved\":6", "\"available\":7")
+
+	checkInvoke(t, stub, [][]byte{[]byte("cancelOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), first}, "\"status\":\"CANCELLED\"", "\"outstanding\":2")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"reserved\":4", "\"available\":9")
+
+	checkInvoke(t, stub, [][]byte{[]byte("rejectOrder"), []byte("BAYER"), []byte("FarmaciaSol"), second, []byte("Discontinued")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryOrder"), []byte("BAYER"), []byte("FarmaciaSol"), second}, "\"status\":\"REJECTED\"", "Discontinued")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryStock"), []byte("BAYER"), []byte("IBUPROFENO")}, "\"reserved\":0", "\"available\":13")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryBackorders"), []byte("BAYER")}, "[]")
+}
+
+func Test_givenAMedicineWithoutActiveAuthorizationWhenAddMedicineOrderThenError(t *testing.T) {
+	stub, _ := authorizedLab(t)
+
+	order := [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")}
+
+	res := stub.MockInvoke("tx1", order)
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, "holds no marketing authorization") {
+		fmt.Println("Invoke", order, "did not fail for a missing authorization", res.Message)
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/07/2018")})
+	res = stub.MockInvoke("tx1", order)
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, "pending approval") {
+		fmt.Println("Invoke", order, "did not fail for a pending authorization", res.Message)
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE")})
+	checkInvokeWithTxID(t, stub, "tx1", order)
+
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("REVOKED")})
+	res = stub.MockInvoke("tx2", order)
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, "has been revoked") {
+		fmt.Println("Invoke", order, "did not fail for a revoked authorization", res.Message)
+		t.FailNow()
+	}
+	checkState(t, stub, "BAYER", "\"medicine\":\"IBUPROFENO\"", "\"status\":\"REVOKED\"")
+}
+
+func Test_givenARejectedOrExpiredAuthorizationWhenAddMedicineOrderThenError(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO", "ASPIRINA")
+
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("REJECTED")})
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("EXPIRED"), []byte("31/12/2018")})
+	checkState(t, stub, "BAYER", "\"status\":\"REJECTED\"", "\"status\":\"EXPIRED\"")
+
+	for medicine, message := range map[string]string{"IBUPROFENO": "has been rejected", "ASPIRINA": "expired on 2018-12-31T00:00:00Z"} {
+		order := [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte(medicine), []byte(medicine + "DESC"), []byte("7")}
+		res := stub.MockInvoke("tx1", order)
+		if res.Status != shim.ERROR || !strings.Contains(res.Message, message) {
+			fmt.Println("Invoke", order, "did not fail with", message, res.Message)
+			t.FailNow()
+		}
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("LAPSED")})
+}
+
+func Test_givenARejectedAuthorizationWhenCreateMarketingAuthorizationThenItIsRequestedAgain(t *testing.T) {
+	stub, arm := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("REJECTED")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/09/2018")})
+	checkEvent(t, stub, EventAuthorizationSubmitted, "\"status\":\"PENDING\"")
+	checkState(t, stub, "BAYER", "\"status\":\"PENDING\"", "\"createdDate\":\"2018-09-01T00:00:00Z\"")
+	if len(arm.invocations) != 1 {
+		fmt.Println("Unexpected arm invocations", arm.invocations)
+		t.FailNow()
+	}
+
+	// the new request is pending again, so it cannot be requested a third time
+	checkInvokeError(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/10/2018")})
+}
+
+func Test_givenAnExpiredAuthorizationWhenCreateMarketingAuthorizationThenItIsRequestedAgain(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO", "ASPIRINA")
+
+	// an active authorization is in place until its validity window is over
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("ACTIVE"), []byte("01/01/2099")})
+	checkInvokeError(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("ASPIRINA"), []byte("01/09/2018")})
+
+	// the expiry counts whether the arm chaincode pushed it or not
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("SUSPENDED"), []byte("31/12/2018")})
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("EXPIRED"), []byte("31/12/2018")})
+	for _, medicine := range []string{"IBUPROFENO", "ASPIRINA"} {
+		checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte(medicine), []byte("01/09/2019")})
+		checkEvent(t, stub, EventAuthorizationSubmitted, "\"medicine\":\""+medicine+"\"", "\"status\":\"PENDING\"")
+	}
+	for _, status := range []string{"EXPIRED", "SUSPENDED"} {
+		if strings.Contains(string(stub.State["BAYER"]), "\"status\":\""+status+"\"") {
+			fmt.Println("State value BAYER still holds a", status, "authorization")
+			t.FailNow()
+		}
+	}
+}
+
+func Test_givenAnARMChaincodeWhenCreateMarketingAuthorizationThenLaboratoryIsUpdated(t *testing.T) {
+	scc := new(SmartContract)
+	stub := shim.NewMockStub("ex01", scc)
+	arm := new(armChaincode)
+	stub.MockPeerChaincode("armcc/armchannel", shim.NewMockStub("armcc", arm))
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("armcc"), []byte("armchannel")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("BAYER"), []byte("15/03/2018"), []byte("1st Street"), []byte("OWNER1")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/07/2018")})
+	checkState(t, stub, "BAYER", "\"medicine\":\"IBUPROFENO\"", "\"status\":\"PENDING\"")
+	checkEvent(t, stub, EventAuthorizationSubmitted, "\"armOwner\":\"OWNER1\"", "\"medicine\":\"IBUPROFENO\"", "\"date\":\"2018-07-01T00:00:00Z\"")
+	if len(arm.invocations) != 1 || strings.Join(arm.invocations[0], ",") != "addMarketingAuthorization,OWNER1,BAYER,IBUPROFENO,2018-07-01T00:00:00Z" {
+		fmt.Println("Unexpected arm invocations", arm.invocations)
+		t.FailNow()
+	}
+
+	// the same authorization cannot be requested twice
+	checkInvokeError(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/07/2018")})
+
+	// a failure in the arm chaincode leaves the laboratory untouched
+	checkInvokeError(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER2"), []byte("BAYER"), []byte("ASPIRINA"), []byte("01/07/2018")})
+	checkNoEvent(t, stub)
+	if strings.Contains(string(stub.State["BAYER"]), "ASPIRINA") {
+		fmt.Println("State value BAYER contains ASPIRINA")
+		t.FailNow()
+	}
+}
+
+func Test_givenANewARMChaincodeWhenSetARMChaincodeThenItIsInvoked(t *testing.T) {
+	scc := &signedLab{creator: identity(t, "regulator1", "regulator")}
+	stub := shim.NewMockStub("ex01", scc)
+	arm := new(armChaincode)
+	stub.MockPeerChaincode("arm2/otherchannel", shim.NewMockStub("arm2", arm))
+
+	checkInit(t, stub, [][]byte{[]byte("init")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("BAYER"), []byte("15/03/2018"), []byte("1st Street"), []byte("OWNER1")})
+	checkInvoke(t, stub, [][]byte{[]byte("setARMChaincode"), []byte("arm2"), []byte("otherchannel")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/07/2018")})
+	if len(arm.invocations) != 1 {
+		fmt.Println("Unexpected arm invocations", arm.invocations)
+		t.FailNow()
+	}
+}
+
+func Test_givenAClientWhoIsNotARegulatorWhenSetARMChaincodeThenError(t *testing.T) {
+	scc := &signedLab{creator: identity(t, "pharmacy1", "")}
+	stub := shim.NewMockStub("ex01", scc)
+
+	checkInit(t, stub, [][]byte{[]byte("init")})
+	checkInvokeError(t, stub, [][]byte{[]byte("setARMChaincode"), []byte("evil"), []byte("mychannel")})
+
+	scc.creator = identity(t, "owner1", "owner")
+	checkInvokeError(t, stub, [][]byte{[]byte("setARMChaincode"), []byte("evil"), []byte("mychannel")})
+
+	// MockStub has no client identity at all
+	checkInvokeError(t, shim.NewMockStub("ex01", new(SmartContract)), [][]byte{[]byte("setARMChaincode"), []byte("evil"), []byte("mychannel")})
+}
+
+func Test_givenCompositeKeyRecordsWhenConstructQueryPageThenPageIsValidJSON(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+
+	startKey, _ := stub.CreateCompositeKey(orderIndex, []string{"BAYER"})
+	pageAsBytes, err := constructQueryPage(shim.NewMockStateRangeQueryIterator(stub, startKey, startKey+"\U0010FFFF"), &sc.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: "next"})
+	if err != nil {
+		fmt.Println("constructQueryPage failed", err)
+		t.FailNow()
+	}
+
+	page := QueryPage{}
+	if err := json.Unmarshal(pageAsBytes, &page); err != nil {
+		fmt.Println("Page", string(pageAsBytes), "is not valid JSON", err)
+		t.FailNow()
+	}
+	if len(page.Records) != 1 || page.FetchedRecordsCount != 1 || page.Bookmark != "next" || !strings.Contains(string(page.Records[0].Record), "tx1") {
+		fmt.Println("Unexpected page", string(pageAsBytes))
+		t.FailNow()
+	}
+}
+
+func Test_givenAnInvalidPageSizeWhenQueryOrdersByLabWithPaginationThenError(t *testing.T) {
+	scc := new(SmartContract)
+	stub := shim.NewMockStub("ex01", scc)
+
+	checkInvokeError(t, stub, [][]byte{[]byte("queryOrdersByLabWithPagination"), []byte("BAYER"), []byte("0"), []byte("")})
+}
+
+func Test_givenASuspendedAuthorizationWhenAddMedicineOrderThenError(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("SUSPENDED")})
+	checkState(t, stub, "BAYER", "\"status\":\"SUSPENDED\"")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	checkInvokeError(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("GLX"), []byte("IBUPROFENO"), []byte("ACTIVE")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+}
+
+func Test_givenAnUnregisteredMedicineWhenAddMedicineOrderThenError(t *testing.T) {
+	stub, arm := authorizedLab(t, "PARACETAMOL")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("PARACETAMOL"), []byte("PARACETAMOLDESC"), []byte("7")})
+	if len(arm.invocations) != 1 || strings.Join(arm.invocations[0], " ") != "queryMedicine PARACETAMOL" {
+		fmt.Println("ARM chaincode invocations were", arm.invocations)
+		t.FailNow()
+	}
+}
+
+func Test_givenAnOrderWhenItChangesStatusThenAnEventIsEmitted(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("100")})
+	orderID := checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	checkEvent(t, stub, EventOrderCreated, "\"orderId\":\"tx1\"", "\"pharmacy\":\"FarmaciaAluche\"", "\"status\":\"CREATED\"")
+
+	order := [][]byte{[]byte("BAYER"), []byte("FarmaciaAluche"), orderID}
+	checkInvoke(t, stub, append([][]byte{[]byte("acknowledgeOrder")}, order...))
+	checkEvent(t, stub, EventOrderAcknowledged, "\"status\":\"ACKNOWLEDGED\"")
+	checkInvoke(t, stub, append(append([][]byte{[]byte("SendOrder")}, order...), []byte("3")))
+	checkEvent(t, stub, EventOrderSent, "\"shipped\":3", "\"outstanding\":4", "\"status\":\"PARTIALLY_SENT\"")
+	checkInvoke(t, stub, append([][]byte{[]byte("SendOrder")}, order...))
+	checkEvent(t, stub, EventOrderSent, "\"shipped\":4", "\"outstanding\":0", "\"status\":\"SENT\"")
+	checkInvoke(t, stub, append([][]byte{[]byte("confirmOrderArrival")}, order...))
+	checkEvent(t, stub, EventOrderArrived, "\"status\":\"ARRIVED\"")
+
+	// failed transactions emit nothing
+	checkInvokeError(t, stub, append([][]byte{[]byte("cancelOrder")}, order...))
+	checkNoEvent(t, stub)
+
+	orderID = checkInvokeWithTxID(t, stub, "tx2", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("2")})
+	checkEvent(t, stub, EventOrderCreated, "\"orderId\":\"tx2\"")
+	checkInvoke(t, stub, [][]byte{[]byte("rejectOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), orderID, []byte("Out of stock")})
+	checkEvent(t, stub, EventOrderRejected, "\"reason\":\"Out of stock\"")
+}
+
+func Test_givenAClientWhoIsNotARegulatorWhenSetAuthorizationStatusThenError(t *testing.T) {
+	scc := &signedLab{creator: identity(t, "regulator1", "regulator")}
+	stub := shim.NewMockStub("ex01", scc)
+	stub.MockPeerChaincode("arm/mychannel", shim.NewMockStub("arm", new(armChaincode)))
+
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("BAYER"), []byte("15/03/2018"), []byte("1st Street"), []byte("OWNER1")})
+	checkInvoke(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/07/2018")})
+
+	scc.creator = identity(t, "owner1", "owner")
+	checkInvokeError(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE")})
+	checkState(t, stub, "BAYER", "\"status\":\"PENDING\"")
+
+	// nor can it add authorizations
+	checkInvokeError(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("ACTIVE")})
+	if strings.Contains(string(stub.State["BAYER"]), "ASPIRINA") {
+		fmt.Println("State value BAYER contains ASPIRINA")
+		t.FailNow()
+	}
+
+	scc.creator = identity(t, "regulator1", "regulator")
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE")})
+	checkState(t, stub, "BAYER", "\"status\":\"ACTIVE\"")
+}
+
+func Test_givenAnAuthorizationFiledWithTheARMChaincodeWhenSetAuthorizationStatusThenItIsAdded(t *testing.T) {
+	stub, arm := authorizedLab(t, "IBUPROFENO")
+	order := [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("ASPIRINA"), []byte("ASPIRINADESC"), []byte("7")}
+
+	// the ARM owner filed ASPIRINA with addMarketingAuthorization, the lab hears of it on approval
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("ACTIVE"), []byte("01/01/2099")})
+	checkState(t, stub, "BAYER", "\"medicine\":\"ASPIRINA\"", "\"validUntil\":\"2099-01-01T00:00:00Z\"")
+	if len(arm.invocations) != 0 {
+		fmt.Println("Unexpected arm invocations", arm.invocations)
+		t.FailNow()
+	}
+	checkInvokeWithTxID(t, stub, "tx1", order)
+
+	// later decisions apply to it as to any other
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("SUSPENDED")})
+	res := stub.MockInvoke("tx2", order)
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, "is suspended") {
+		fmt.Println("Invoke", order, "did not fail for a suspended authorization", res.Message)
+		t.FailNow()
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("ASPIRINA"), []byte("REVOKED")})
+	checkState(t, stub, "BAYER", "\"status\":\"REVOKED\"")
+	if strings.Count(string(stub.State["BAYER"]), "\"medicine\":\"ASPIRINA\"") != 1 {
+		fmt.Println("State value BAYER holds ASPIRINA more than once", string(stub.State["BAYER"]))
+		t.FailNow()
+	}
+}
+
+func Test_givenALegacyAuthorizationWithoutStatusWhenAddMedicineOrderThenItIsPending(t *testing.T) {
+	stub, _ := newLab(t)
+
+	// an authorization as createMarketingAuthorization stored it before the approval workflow
+	stub.MockTransactionStart("legacy")
+	stub.PutState("BAYER", []byte(`{"laboratoryName":"BAYER","createdDate":"15/03/2018","address":"1st Street","armOwner":"OWNER1",`+
+		`"authorizations":[{"medicine":"IBUPROFENO","createdDate":"01/07/2018"}]}`))
+	stub.MockTransactionEnd("legacy")
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, "pending approval") {
+		fmt.Println("addMedicineOrder returned", res.Status, res.Message)
+		t.FailNow()
+	}
+	checkInvokeError(t, stub, [][]byte{[]byte("createMarketingAuthorization"), []byte("OWNER1"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("01/08/2018")})
+
+	// the arm chaincode's decision settles it
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE")})
+	checkInvoke(t, stub, [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+}
+
+func Test_givenAnAuthorizationPastItsValidityWhenAddMedicineOrderThenError(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO")
+	order := [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")}
+
+	// the lab does not wait for the arm chaincode to push the expiry, it works it out
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE"), []byte("01/01/2018")})
+	checkState(t, stub, "BAYER", "\"validUntil\":\"2018-01-01T00:00:00Z\"")
+	res := stub.MockInvoke("tx1", order)
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, "expired on 2018-01-01T00:00:00Z") {
+		fmt.Println("Invoke", order, "did not fail for an expired authorization", res.Message)
+		t.FailNow()
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE"), []byte("someday")})
+
+	// a renewal pushes the new end of the window
+	checkInvoke(t, stub, [][]byte{[]byte("setAuthorizationStatus"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("ACTIVE"), []byte("2099-01-01T00:00:00Z")})
+	checkInvokeWithTxID(t, stub, "tx1", order)
+}
+
+func Test_givenSeveralPagesWhenQueryWithPaginationThenTheBookmarkFetchesTheNextPage(t *testing.T) {
+	stub, _ := authorizedLab(t, "IBUPROFENO", "ASPIRINA")
+
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("10")})
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("IBUPROFENO"), []byte("L2"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("5")})
+	checkInvoke(t, stub, [][]byte{[]byte("registerBatch"), []byte("BAYER"), []byte("ASPIRINA"), []byte("L1"), []byte("01/03/2018"), []byte("01/03/2099"), []byte("20")})
+	checkInvokeWithTxID(t, stub, "tx1", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaAluche"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("7")})
+	checkInvokeWithTxID(t, stub, "tx2", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaSol"), []byte("ASPIRINA"), []byte("ASPIRINADESC"), []byte("3")})
+	checkInvokeWithTxID(t, stub, "tx3", [][]byte{[]byte("addMedicineOrder"), []byte("BAYER"), []byte("FarmaciaSol"), []byte("IBUPROFENO"), []byte("IBUPROFENODESC"), []byte("2")})
+
+	// one medicine per page, however many lots it has
+	var medicines []string
+	bookmark := ""
+	for page := 0; page == 0 || bookmark != ""; page++ {
+		res := stub.MockInvoke("1", [][]byte{[]byte("queryStockWithPagination"), []byte("BAYER"), []byte("1"), []byte(bookmark)})
+		stock := QueryPage{}
+		if res.Status != shim.OK || json.Unmarshal(res.Payload, &stock) != nil || len(stock.Records) != 1 || page > 1 {
+			fmt.Println("queryStockWithPagination returned", res.Message, string(res.Payload))
+			t.FailNow()
+		}
+		summary := StockSummary{}
+		json.Unmarshal(stock.Records[0].Record, &summary)
+		medicines = append(medicines, fmt.Sprint(summary.Medicine, " ", summary.OnHand))
+		bookmark = stock.Bookmark
+	}
+	if strings.Join(medicines, ",") != "ASPIRINA 20,IBUPROFENO 15" {
+		fmt.Println("queryStockWithPagination paged through", medicines)
+		t.FailNow()
+	}
+
+	// the orders are paged, the laboratory comes with every page
+	var pharmacies []string
+	bookmark = ""
+	for page := 0; page == 0 || bookmark != ""; page++ {
+		res := stub.MockInvoke("1", [][]byte{[]byte("queryByLabWithPagination"), []byte("BAYER"), []byte("2"), []byte(bookmark)})
+		lab := LabPage{}
+		if res.Status != shim.OK || json.Unmarshal(res.Payload, &lab) != nil || lab.Address != "1st Street" || page > 1 {
+			fmt.Println("queryByLabWithPagination returned", res.Message, string(res.Payload))
+			t.FailNow()
+		}
+		for _, pharmacy := range lab.Pharmacy {
+			pharmacies = append(pharmacies, fmt.Sprint(pharmacy.Pharmacy, " ", len(pharmacy.Order)))
+		}
+		bookmark = lab.Bookmark
+	}
+	if strings.Join(pharmacies, ",") != "FarmaciaAluche 1,FarmaciaSol 1,FarmaciaSol 1" {
+		fmt.Println("queryByLabWithPagination paged through", pharmacies)
+		t.FailNow()
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("queryByLabWithPagination"), []byte("GLX"), []byte("2"), []byte("")})
+	checkInvokeError(t, stub, [][]byte{[]byte("queryStockWithPagination"), []byte("BAYER"), []byte("0"), []byte("")})
+}
+
+func Test_givenALaboratoryTransferredInTheARMChaincodeWhenSyncARMOwnerThenItsOwnerIsUpdated(t *testing.T) {
+	stub, _ := authorizedLab(t)
+	checkState(t, stub, "BAYER", "\"armOwner\":\"OWNER1\"")
+
+	// BAYER now belongs to OWNER2 in the arm chaincode
+	res := stub.MockInvoke("1", [][]byte{[]byte("syncARMOwner"), []byte("BAYER")})
+	if res.Status != shim.OK || string(res.Payload) != "OWNER2" {
+		fmt.Println("syncARMOwner BAYER returned", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+	checkState(t, stub, "BAYER", "\"armOwner\":\"OWNER2\"", "1st Street")
+
+	// a laboratory the arm chaincode does not place under exactly one ARM is left alone
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("ROCHE"), []byte("15/03/2018"), []byte("2nd Street"), []byte("OWNER1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("syncARMOwner"), []byte("ROCHE")})
+	checkInvoke(t, stub, [][]byte{[]byte("addLaboratory"), []byte("GLX"), []byte("15/03/2018"), []byte("3rd Street"), []byte("OWNER1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("syncARMOwner"), []byte("GLX")})
+	checkState(t, stub, "GLX", "\"armOwner\":\"OWNER1\"")
+	checkInvokeError(t, stub, [][]byte{[]byte("syncARMOwner"), []byte("NOVARTIS")})
+}
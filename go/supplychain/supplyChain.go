@@ -25,14 +25,21 @@
 package main
 
 /* Imports
- * 4 utility libraries for formatting, handling bytes, reading and writing JSON, and string manipulation
- * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
+ * 8 utility libraries for formatting, handling bytes, reading and writing JSON, distances,
+ * ID patterns, sorting readings, parsing numbers and dates
+ * 3 specific Hyperledger Fabric specific libraries for Smart Contracts and client identities
  */
 import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -47,19 +54,253 @@ type Transit struct {
 	HaulierReceptor string `json:"haulierreceptor"`
 }
 
+// earthRadiusKm is the mean radius of the Earth used by the haversine distance
+const earthRadiusKm = 6371.0
+
+// maxPlausibleSpeedKmh is the speed above which a leg between two transits is taken
+// for a GPS jump rather than a real journey
+const maxPlausibleSpeedKmh = 1000.0
+
+// RouteLeg is the journey of an asset between two consecutive transits. Reason tells why
+// an implausible leg is flagged
+type RouteLeg struct {
+	From          string  `json:"from"`
+	To            string  `json:"to"`
+	Start         string  `json:"start"`
+	End           string  `json:"end"`
+	DistanceKm    float64 `json:"distanceKm"`
+	DurationHours float64 `json:"durationHours"`
+	SpeedKmh      float64 `json:"speedKmh"`
+	Implausible   bool    `json:"implausible"`
+	Reason        string  `json:"reason,omitempty"`
+}
+
+// RouteMetrics sums up the legs travelled by an asset. Implausible is set when any of the
+// legs is implausible, so the totals should not be trusted either
+type RouteMetrics struct {
+	ID              string     `json:"id"`
+	DistanceKm      float64    `json:"distanceKm"`
+	DurationHours   float64    `json:"durationHours"`
+	AverageSpeedKmh float64    `json:"averageSpeedKmh"`
+	Implausible     bool       `json:"implausible"`
+	Legs            []RouteLeg `json:"legs"`
+}
+
 type Arrival struct {
 	Date   string `json:"date"`
 	Status string `json:"status"`
 }
 
+// assetDocType is the document type of assets, used by CouchDB rich queries
+const assetDocType = "asset"
+
+// assetIndex is the composite key object type under which assets are stored
+const assetIndex = "asset"
+
+// assetIDPattern is the format of the asset IDs chosen by callers
+var assetIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// Asset is a shipment followed along the supply chain. Thermolabile assets carry the
+// temperature range they must be kept in and the excursions detected from sensor readings.
+// OutOfRange is the current run of out of range readings not yet as long as the tolerance
 type Asset struct {
-	Type     string    `json:"type"`
-	Qty      string    `json:"qty"`
-	Price    string    `json:"price"`
-	DateL    string    `json:"datel"`
-	Agent    string    `json:"agent"`
-	Transits []Transit `json:"transits"`
-	Arrivals []Arrival `json:"arrival"`
+	DocType          string            `json:"docType"`
+	ID               string            `json:"id"`
+	Type             string            `json:"type"`
+	Qty              string            `json:"qty"`
+	Price            string            `json:"price"`
+	DateL            string            `json:"datel"`
+	Agent            string            `json:"agent"`
+	Transits         []Transit         `json:"transits"`
+	Arrivals         []Arrival         `json:"arrival"`
+	TemperatureRange *TemperatureRange `json:"temperatureRange,omitempty"`
+	LastReading      string            `json:"lastReading,omitempty"`
+	OutOfRange       *Excursion        `json:"outOfRange,omitempty"`
+	Excursions       []Excursion       `json:"excursions,omitempty"`
+}
+
+// TemperatureRange is the allowed temperature of an asset in °C. Readings may leave it for
+// less than ToleranceMinutes before an excursion is flagged, with no tolerance the first
+// out of range reading is one
+type TemperatureRange struct {
+	MinCelsius       float64 `json:"minCelsius"`
+	MaxCelsius       float64 `json:"maxCelsius"`
+	ToleranceMinutes int64   `json:"toleranceMinutes"`
+}
+
+// contains tells whether a temperature is within the range
+func (r *TemperatureRange) contains(celsius float64) bool {
+	return celsius >= r.MinCelsius && celsius <= r.MaxCelsius
+}
+
+// deviation is how far a temperature is outside the range, 0 within it
+func (r *TemperatureRange) deviation(celsius float64) float64 {
+	if celsius < r.MinCelsius {
+		return r.MinCelsius - celsius
+	}
+	if celsius > r.MaxCelsius {
+		return celsius - r.MaxCelsius
+	}
+	return 0
+}
+
+// SensorReading is a measure taken by a sensor travelling with an asset
+type SensorReading struct {
+	DocType  string  `json:"docType,omitempty"`
+	AssetID  string  `json:"assetId,omitempty"`
+	Time     string  `json:"time"`
+	Celsius  float64 `json:"celsius"`
+	Humidity float64 `json:"humidity"`
+	SensorID string  `json:"sensorId"`
+}
+
+// Excursion is a period the temperature of an asset stayed out of range for longer than
+// the tolerance. End is empty while the excursion is open, PeakCelsius is the reading
+// furthest from the range
+type Excursion struct {
+	Start       string  `json:"start"`
+	Detected    string  `json:"detected,omitempty"`
+	End         string  `json:"end,omitempty"`
+	PeakCelsius float64 `json:"peakCelsius"`
+	SensorID    string  `json:"sensorId"`
+}
+
+// openExcursion returns the excursion of the asset still open, or nil if there is none
+func (a *Asset) openExcursion() *Excursion {
+	if len(a.Excursions) == 0 || a.Excursions[len(a.Excursions)-1].End != "" {
+		return nil
+	}
+	return &a.Excursions[len(a.Excursions)-1]
+}
+
+// record applies a reading to the excursion state of the asset. Out of range readings
+// start a run that becomes an excursion once it lasts as long as the tolerance, an in
+// range reading ends the run and closes the open excursion
+func (a *Asset) record(reading SensorReading) {
+	r := a.TemperatureRange
+	open := a.openExcursion()
+
+	if r.contains(reading.Celsius) {
+		a.OutOfRange = nil
+		if open != nil {
+			open.End = reading.Time
+		}
+		return
+	}
+
+	if open != nil {
+		open.peak(r, reading)
+		return
+	}
+	if a.OutOfRange == nil {
+		a.OutOfRange = &Excursion{Start: reading.Time, PeakCelsius: reading.Celsius, SensorID: reading.SensorID}
+	} else {
+		a.OutOfRange.peak(r, reading)
+	}
+
+	start, _ := time.Parse(time.RFC3339, a.OutOfRange.Start)
+	now, _ := time.Parse(time.RFC3339, reading.Time)
+	if now.Sub(start) >= time.Duration(r.ToleranceMinutes)*time.Minute {
+		a.OutOfRange.Detected = reading.Time
+		a.Excursions = append(a.Excursions, *a.OutOfRange)
+		a.OutOfRange = nil
+	}
+}
+
+// closeExcursion ends the open excursion at date and drops the current run of out of
+// range readings. It returns the excursion it closed, or nil if none was open
+func (a *Asset) closeExcursion(date string) *Excursion {
+	a.OutOfRange = nil
+	open := a.openExcursion()
+	if open != nil {
+		open.End = date
+	}
+	return open
+}
+
+// peak keeps the reading furthest from the range
+func (e *Excursion) peak(r *TemperatureRange, reading SensorReading) {
+	if r.deviation(reading.Celsius) > r.deviation(e.PeakCelsius) {
+		e.PeakCelsius = reading.Celsius
+		e.SensorID = reading.SensorID
+	}
+}
+
+// readingIndex is the composite key object type under which sensor readings are stored
+const readingIndex = "reading"
+
+// readingDocType is the document type of sensor readings, used by CouchDB rich queries
+const readingDocType = "reading"
+
+// openExcursionIndex is the composite key object type listing the assets with an open excursion
+const openExcursionIndex = "excursion~open"
+
+// Chaincode event names. buyAsset, acceptHandover and arrival each emit one of the asset
+// events, carrying an AssetEvent as JSON payload. Handover events carry the Handover
+const (
+	EventAssetBought       = "supplychain.asset.bought"
+	EventAssetInTransit    = "supplychain.asset.transit"
+	EventAssetArrived      = "supplychain.asset.arrived"
+	EventHandoverProposed  = "supplychain.handover.proposed"
+	EventHandoverCancelled = "supplychain.handover.cancelled"
+	EventExcursionOpened   = "supplychain.excursion.opened"
+	EventExcursionClosed   = "supplychain.excursion.closed"
+)
+
+// handoverIndex is the composite key object type under which pending handovers are stored,
+// one per asset
+const handoverIndex = "handover"
+
+// handoverDocType is the document type of pending handovers, used by CouchDB rich queries
+const handoverDocType = "handover"
+
+// handoverValidity is how long a handover can be accepted when no expiry is given
+const handoverValidity = 24 * time.Hour
+
+// haulierAttribute is the certificate attribute naming the haulier a client acts for
+const haulierAttribute = "haulier"
+
+// Handover is a custody transfer proposed by the current agent of an asset. The transit
+// is only appended to the asset when the receiving haulier accepts it
+type Handover struct {
+	DocType      string  `json:"docType"`
+	AssetID      string  `json:"assetId"`
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Transit      Transit `json:"transit"`
+	ProposedDate string  `json:"proposedDate"`
+	ExpiresAt    string  `json:"expiresAt"`
+}
+
+// isExpired tells whether the handover can no longer be accepted at date
+func (h *Handover) isExpired(date string) bool {
+	return h.ExpiresAt <= date
+}
+
+// AssetEvent is the payload of the asset chaincode events. Transit is the transit the
+// transaction recorded, Arrival is only set on supplychain.asset.arrived and Excursion
+// on the excursion events
+type AssetEvent struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Qty       string     `json:"qty"`
+	Agent     string     `json:"agent"`
+	Transit   *Transit   `json:"transit,omitempty"`
+	Arrival   *Arrival   `json:"arrival,omitempty"`
+	Excursion *Excursion `json:"excursion,omitempty"`
+}
+
+// QueryPage is a page of query results along with the bookmark of the next page
+type QueryPage struct {
+	Records             []QueryRecord `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// QueryRecord is a ledger entry returned by a query
+type QueryRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record,omitempty"`
 }
 
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
@@ -73,14 +314,46 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	// Route to the appropriate handler function to interact with the ledger appropriately
 	if function == "queryAllAssets" {
 		return s.queryAllAssets(APIstub)
+	} else if function == "queryAllAssetsWithPagination" {
+		return s.queryAllAssetsWithPagination(APIstub, args)
+	} else if function == "queryAssetsByAgentWithPagination" {
+		return s.queryAssetsByAgentWithPagination(APIstub, args)
 	} else if function == "queryAssets" {
 		return s.queryAssets(APIstub)
+	} else if function == "queryAssetsWithPagination" {
+		return s.queryAssetsWithPagination(APIstub, args)
+	} else if function == "setTemperatureRange" {
+		return s.setTemperatureRange(APIstub, args)
+	} else if function == "addSensorReadings" {
+		return s.addSensorReadings(APIstub, args)
+	} else if function == "querySensorReadings" {
+		return s.querySensorReadings(APIstub, args)
+	} else if function == "querySensorReadingsWithPagination" {
+		return s.querySensorReadingsWithPagination(APIstub, args)
+	} else if function == "queryAssetsWithOpenExcursions" {
+		return s.queryAssetsWithOpenExcursions(APIstub)
+	} else if function == "queryAssetsWithOpenExcursionsWithPagination" {
+		return s.queryAssetsWithOpenExcursionsWithPagination(APIstub, args)
+	} else if function == "queryRouteMetrics" {
+		return s.queryRouteMetrics(APIstub, args)
 	} else if function == "queryByAsset" {
 		return s.queryByAsset(APIstub, args)
+	} else if function == "queryAssetsByAgent" {
+		return s.queryAssetsByAgent(APIstub, args)
 	} else if function == "buyAsset" {
 		return s.buyAsset(APIstub, args)
-	} else if function == "generateTransit" {
-		return s.generateTransit(APIstub, args)
+	} else if function == "migrateAssets" {
+		return s.migrateAssets(APIstub, args)
+	} else if function == "proposeHandover" {
+		return s.proposeHandover(APIstub, args)
+	} else if function == "acceptHandover" {
+		return s.acceptHandover(APIstub, args)
+	} else if function == "cancelHandover" {
+		return s.cancelHandover(APIstub, args)
+	} else if function == "queryPendingHandovers" {
+		return s.queryPendingHandovers(APIstub, args)
+	} else if function == "queryPendingHandoversWithPagination" {
+		return s.queryPendingHandoversWithPagination(APIstub, args)
 	} else if function == "arrival" {
 		return s.arrival(APIstub, args)
 	}
@@ -88,185 +361,1351 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	return shim.Error("Invalid Smart Contract function name.")
 }
 
+// ./executeTransaction.sh '{"Args":["buyAsset", "", "IBUPROFENO", "100", "250", "01/03/2018", "HAULIER1", "40.41", "-3.70", "01/03/2018", ""]}' supplycc
+// An empty ID lets the chaincode allocate one from the transaction ID. The ID is returned.
+// Only the haulier named as AGENT may register the asset it carries
 func (s *SmartContract) buyAsset(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 10 {
 		return shim.Error("Incorrect number of arguments. Expecting 10")
 	}
 
+	if err := checkHaulier(APIstub, args[5]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	id := args[0]
+	if len(id) == 0 {
+		id = "ASSET" + APIstub.GetTxID()
+	} else if !assetIDPattern.MatchString(id) {
+		return shim.Error("Invalid asset ID " + id + ". Expecting up to 128 letters, digits, '-' or '_'")
+	}
+
+	existing, err := getAsset(APIstub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Asset " + id + " already exists")
+	}
+
+	dateL, err := parseDate(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transitTime, err := parseDate(args[8])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lat, lon, err := parseLocation(args[6], args[7])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	var transit = Transit{
-		LocLatitude:     args[6],
-		LocLongitude:    args[7],
-		Time:            args[8],
+		LocLatitude:     lat,
+		LocLongitude:    lon,
+		Time:            transitTime,
 		HaulierReceptor: args[5],
 	}
 
 	var asset = Asset{
+		ID:       id,
 		Type:     args[1],
 		Qty:      args[2],
 		Price:    args[3],
-		DateL:    args[4],
+		DateL:    dateL,
 		Agent:    args[5],
 		Transits: []Transit{transit},
 		Arrivals: nil,
 	}
-	assetAsBytes, _ := json.Marshal(asset)
-	APIstub.PutState(args[0], assetAsBytes)
+	if err := putAsset(APIstub, &asset); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(nil)
+	if err := emitAssetEvent(APIstub, EventAssetBought, AssetEvent{ID: id, Type: asset.Type, Qty: asset.Qty, Agent: asset.Agent, Transit: &transit}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(id))
 }
 
-func (s *SmartContract) generateTransit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+// ./executeTransaction.sh '{"Args":["migrateAssets", "ASSET0", "ASSET999"]}' supplycc
+// Moves the assets stored under plain keys from START up to END (exclusive), as they were
+// before the asset namespace, into the namespace. Returns the IDs of the moved assets
+func (s *SmartContract) migrateAssets(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {START, END}")
 	}
 
-	var transit = Transit{
-		LocLatitude:     args[1],
-		LocLongitude:    args[2],
-		Time:            args[3],
-		HaulierReceptor: args[4],
+	if len(args[0]) == 0 || len(args[1]) == 0 {
+		return shim.Error("Empty key. Expecting a START and an END")
+	}
+
+	resultsIterator, err := APIstub.GetStateByRange(args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	ids := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		asset := Asset{}
+		if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+			return shim.Error("Key " + queryResponse.Key + " does not hold an asset")
+		}
+		asset.ID = queryResponse.Key
+		if err := putAsset(APIstub, &asset); err != nil {
+			return shim.Error(err.Error())
+		}
+		ids = append(ids, asset.ID)
+	}
+
+	idsAsBytes, _ := json.Marshal(ids)
+	return shim.Success(idsAsBytes)
+}
+
+// ./executeTransaction.sh '{"Args":["proposeHandover", "ASSET1", "HAULIER2", "40.41", "-3.70", "02/03/2018", "03/03/2018"]}' supplycc
+// Only the current agent of the asset may propose a handover. EXPIRES_AT is optional,
+// handovers can be accepted for handoverValidity otherwise
+func (s *SmartContract) proposeHandover(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 or 6 {ID, TO, LAT, LON, TIME[, EXPIRES_AT]}")
 	}
 
-	assetAsBytes, err := APIstub.GetState(args[0])
+	asset, err := getAsset(APIstub, args[0])
 	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
 		return shim.Error("Failed to get specified Asset")
 	}
+	if err := checkHaulier(APIstub, asset.Agent); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args[1]) == 0 || args[1] == asset.Agent {
+		return shim.Error("Invalid receiving haulier. Expecting a haulier other than " + asset.Agent)
+	}
 
-	asset := Asset{}
-	json.Unmarshal(assetAsBytes, &asset)
+	transitTime, err := parseDate(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(asset.Transits) > 0 {
+		// older transits may still be in dd/mm/yyyy
+		lastTime, err := parseDate(asset.Transits[len(asset.Transits)-1].Time)
+		if err == nil && transitTime < lastTime {
+			return shim.Error("Invalid transit time " + args[4] + ". Expecting a time not earlier than " + lastTime)
+		}
+	}
+
+	lat, lon, err := parseLocation(args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t, _ := time.Parse(time.RFC3339, date)
+	expiresAt := t.Add(handoverValidity).Format(time.RFC3339)
+	if len(args) == 6 {
+		expiresAt, err = parseDate(args[5])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if expiresAt <= date {
+			return shim.Error("Invalid expiry " + args[5] + ". Expecting a date after " + date)
+		}
+	}
 
-	asset.Agent = args[4]
+	// an expired handover no longer blocks a new proposal
+	pending, err := getHandover(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pending != nil && !pending.isExpired(date) {
+		return shim.Error(fmt.Sprintf("Asset %s already has a pending handover to %s", args[0], pending.To))
+	}
 
-	asset.Transits = append(asset.Transits, transit)
-	fmt.Println("!!! appended transit to Asset")
+	var handover = Handover{
+		AssetID: args[0],
+		From:    asset.Agent,
+		To:      args[1],
+		Transit: Transit{
+			LocLatitude:     lat,
+			LocLongitude:    lon,
+			Time:            transitTime,
+			HaulierReceptor: args[1],
+		},
+		ProposedDate: date,
+		ExpiresAt:    expiresAt,
+	}
+	if err := putHandover(APIstub, &handover); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	assetAsBytes, _ = json.Marshal(asset)
-	APIstub.PutState(args[0], assetAsBytes)
+	if err := emitHandoverEvent(APIstub, EventHandoverProposed, &handover); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) arrival(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+// ./executeTransaction.sh '{"Args":["acceptHandover", "ASSET1"]}' supplycc
+// Only the receiving haulier may accept a handover, which makes it the agent of the asset
+func (s *SmartContract) acceptHandover(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {ID}")
 	}
 
-	var arrival = Arrival{
-		Date:   args[1],
-		Status: args[2],
+	handover, err := getHandover(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if handover == nil {
+		return shim.Error("Asset " + args[0] + " has no pending handover")
+	}
+	if err := checkHaulier(APIstub, handover.To); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if handover.isExpired(date) {
+		return shim.Error("Handover of asset " + args[0] + " expired on " + handover.ExpiresAt)
 	}
 
-	assetAsBytes, err := APIstub.GetState(args[0])
+	asset, err := getAsset(APIstub, args[0])
 	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
 		return shim.Error("Failed to get specified Asset")
 	}
+	if asset.Agent != handover.From {
+		return shim.Error("Asset " + args[0] + " is no longer in the custody of " + handover.From)
+	}
 
-	asset := Asset{}
-	json.Unmarshal(assetAsBytes, &asset)
+	asset.Agent = handover.To
+	asset.Transits = append(asset.Transits, handover.Transit)
 
-	asset.Arrivals = append(asset.Arrivals, arrival)
-	fmt.Println("!!! appended arrival to Asset")
+	if err := putAsset(APIstub, asset); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := deleteHandover(APIstub, handover); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	assetAsBytes, _ = json.Marshal(asset)
-	APIstub.PutState(args[0], assetAsBytes)
+	if err := emitAssetEvent(APIstub, EventAssetInTransit, AssetEvent{ID: args[0], Type: asset.Type, Qty: asset.Qty, Agent: asset.Agent, Transit: &handover.Transit}); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryAllAssets(APIstub shim.ChaincodeStubInterface) sc.Response {
-	startKey := "ASSET0"
-	endKey := "ASSET999"
+// ./executeTransaction.sh '{"Args":["cancelHandover", "ASSET1"]}' supplycc
+// The proposing haulier may cancel a pending handover, anyone may clear an expired one
+func (s *SmartContract) cancelHandover(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {ID}")
+	}
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	handover, err := getHandover(APIstub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
-
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	if handover == nil {
+		return shim.Error("Asset " + args[0] + " has no pending handover")
+	}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !handover.isExpired(date) {
+		if err := checkHaulier(APIstub, handover.From); err != nil {
 			return shim.Error(err.Error())
 		}
+	}
 
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	if err := deleteHandover(APIstub, handover); err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- queryAllAssets:\n%s\n", buffer.String())
+	if err := emitHandoverEvent(APIstub, EventHandoverCancelled, handover); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryAssets(APIstub shim.ChaincodeStubInterface) sc.Response {
-	startKey := "ASSET0"
-	endKey := "ASSET999"
+// ./executeQuery.sh '{"Args":["queryPendingHandovers", "HAULIER2"]}' supplycc
+// Lists the handovers that can still be accepted, optionally only those to HAULIER
+func (s *SmartContract) queryPendingHandovers(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1 {[HAULIER]}")
+	}
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	date, err := txDate(APIstub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
 
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(handoverIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
 
-	bArrayMemberAlreadyWritten := false
+	handovers := []Handover{}
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		handover := Handover{}
+		if err := json.Unmarshal(queryResponse.Value, &handover); err != nil {
+			return shim.Error(err.Error())
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		if handover.isExpired(date) || (len(args) == 1 && handover.To != args[0]) {
+			continue
+		}
+		handovers = append(handovers, handover)
 	}
-	buffer.WriteString("]")
-	fmt.Printf("- queryAllAssets:\n%s\n", buffer.String())
 
-	return shim.Success(buffer.Bytes())
+	handoversAsBytes, _ := json.Marshal(handovers)
+	return shim.Success(handoversAsBytes)
 }
 
-func (s *SmartContract) queryByAsset(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// ./executeQuery.sh '{"Args":["queryPendingHandoversWithPagination", "HAULIER2", "10", ""]}' supplycc
+// HAULIER is optional as in queryPendingHandovers. Each record is keyed by the asset ID and holds the
+// handover. Expired handovers and those to other hauliers are left out, so a page may fall short of PAGESIZE
+func (s *SmartContract) queryPendingHandoversWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3 {[HAULIER,] PAGESIZE, BOOKMARK}")
 	}
 
-	if len(args[0]) == 0 {
-		return shim.Error("Empty key. Expecting an Asset")
+	haulier := ""
+	if len(args) == 3 {
+		haulier, args = args[0], args[1:]
 	}
 
-	assetAsBytes, _ := APIstub.GetState(args[0])
+	pageSize, err := parsePageSize(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	if len(assetAsBytes) == 0 {
-		return shim.Error("Invalid key. Expecting an Asset")
+	date, err := txDate(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(assetAsBytes)
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(handoverIndex, []string{}, pageSize, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructRecordPage(APIstub, resultsIterator, metadata, func(id string, value []byte) ([]byte, error) {
+		handover := Handover{}
+		if err := json.Unmarshal(value, &handover); err != nil {
+			return nil, err
+		}
+		if handover.isExpired(date) || (haulier != "" && handover.To != haulier) {
+			return nil, nil
+		}
+		return value, nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeTransaction.sh '{"Args":["arrival", "ASSET1", "02/03/2018", "OK"]}' supplycc
+// Only the current agent of the asset may record its arrival
+func (s *SmartContract) arrival(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	arrivalDate, err := parseDate(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var arrival = Arrival{
+		Date:   arrivalDate,
+		Status: args[2],
+	}
+
+	asset, err := getAsset(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Failed to get specified Asset")
+	}
+	if err := checkHaulier(APIstub, asset.Agent); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	asset.Arrivals = append(asset.Arrivals, arrival)
+	fmt.Println("!!! appended arrival to Asset")
+
+	if err := putAsset(APIstub, asset); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := emitAssetEvent(APIstub, EventAssetArrived, AssetEvent{ID: args[0], Type: asset.Type, Qty: asset.Qty, Agent: asset.Agent, Arrival: &arrival}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["setTemperatureRange", "ASSET1", "2", "8", "30"]}' supplycc
+// Only the current agent of the asset may set the range it must be kept in, in °C, and how
+// many minutes readings may stay out of it before an excursion is flagged
+// Changing the range closes the open excursion and starts the readings afresh
+func (s *SmartContract) setTemperatureRange(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 {ID, MIN_CELSIUS, MAX_CELSIUS, TOLERANCE_MINUTES}")
+	}
+
+	minCelsius, err := parseCelsius(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	maxCelsius, err := parseCelsius(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if minCelsius > maxCelsius {
+		return shim.Error(fmt.Sprintf("Invalid temperature range %s..%s. Expecting the minimum first", args[1], args[2]))
+	}
+	tolerance, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || tolerance < 0 {
+		return shim.Error("Invalid tolerance " + args[3] + ". Expecting a number of minutes")
+	}
+
+	asset, err := getAsset(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Failed to get specified Asset")
+	}
+	if err := checkHaulier(APIstub, asset.Agent); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the readings so far were judged against the previous range, so whatever they
+	// started ends with the last of them
+	closed := asset.closeExcursion(asset.LastReading)
+	asset.TemperatureRange = &TemperatureRange{MinCelsius: minCelsius, MaxCelsius: maxCelsius, ToleranceMinutes: tolerance}
+	if err := putAsset(APIstub, asset); err != nil {
+		return shim.Error(err.Error())
+	}
+	if closed == nil {
+		return shim.Success(nil)
+	}
+
+	key, err := APIstub.CreateCompositeKey(openExcursionIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := emitAssetEvent(APIstub, EventExcursionClosed, AssetEvent{ID: args[0], Type: asset.Type, Qty: asset.Qty, Agent: asset.Agent, Excursion: closed}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeTransaction.sh '{"Args":["addSensorReadings", "ASSET1", "[{\"time\":\"2018-03-01T08:00:00Z\",\"celsius\":4.5,\"humidity\":60,\"sensorId\":\"S1\"}]"]}' supplycc
+// Only the current agent of the asset may add readings. A batch is applied in time order
+// and may not go back before the last reading of the asset
+func (s *SmartContract) addSensorReadings(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {ID, READINGS}")
+	}
+
+	var readings []SensorReading
+	if err := json.Unmarshal([]byte(args[1]), &readings); err != nil {
+		return shim.Error("Invalid readings. Expecting a JSON array of {time, celsius, humidity, sensorId}")
+	}
+	if len(readings) == 0 {
+		return shim.Error("Empty readings. Expecting at least one reading")
+	}
+
+	asset, err := getAsset(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Failed to get specified Asset")
+	}
+	if asset.TemperatureRange == nil {
+		return shim.Error("Asset " + args[0] + " has no temperature range")
+	}
+	if err := checkHaulier(APIstub, asset.Agent); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the ledger does not show writes of the same transaction, so duplicates within the
+	// batch are caught here and putReading catches those of earlier batches
+	reported := map[string]bool{}
+	for i := range readings {
+		if err := checkReading(&readings[i]); err != nil {
+			return shim.Error(err.Error())
+		}
+		if reported[readings[i].SensorID+" "+readings[i].Time] {
+			return shim.Error(fmt.Sprintf("Sensor %s reported twice at %s", readings[i].SensorID, readings[i].Time))
+		}
+		reported[readings[i].SensorID+" "+readings[i].Time] = true
+	}
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].Time < readings[j].Time })
+	if readings[0].Time < asset.LastReading {
+		return shim.Error(fmt.Sprintf("Invalid reading at %s. Expecting readings after %s", readings[0].Time, asset.LastReading))
+	}
+
+	wasOpen := asset.openExcursion() != nil
+	excursions := len(asset.Excursions)
+	for _, reading := range readings {
+		reading.AssetID = args[0]
+		if err := putReading(APIstub, &reading); err != nil {
+			return shim.Error(err.Error())
+		}
+		asset.record(reading)
+	}
+	asset.LastReading = readings[len(readings)-1].Time
+
+	if err := putAsset(APIstub, asset); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := APIstub.CreateCompositeKey(openExcursionIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	open := asset.openExcursion()
+	if open != nil {
+		err = APIstub.PutState(key, []byte{0x00})
+	} else if wasOpen {
+		err = APIstub.DelState(key)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a batch closing an excursion and opening another one reports the open one
+	event := AssetEvent{ID: args[0], Type: asset.Type, Qty: asset.Qty, Agent: asset.Agent}
+	if open != nil && (!wasOpen || len(asset.Excursions) > excursions) {
+		event.Excursion = open
+		err = emitAssetEvent(APIstub, EventExcursionOpened, event)
+	} else if open == nil && (wasOpen || len(asset.Excursions) > excursions) {
+		event.Excursion = &asset.Excursions[len(asset.Excursions)-1]
+		err = emitAssetEvent(APIstub, EventExcursionClosed, event)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ./executeQuery.sh '{"Args":["querySensorReadings", "ASSET1"]}' supplycc
+func (s *SmartContract) querySensorReadings(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {ID}")
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(readingIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	readings := []SensorReading{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		reading := SensorReading{}
+		if err := json.Unmarshal(queryResponse.Value, &reading); err != nil {
+			return shim.Error(err.Error())
+		}
+		readings = append(readings, reading)
+	}
+
+	readingsAsBytes, _ := json.Marshal(readings)
+	return shim.Success(readingsAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["querySensorReadingsWithPagination", "ASSET1", "100", ""]}' supplycc
+// Readings come in time order, each record keyed by the asset ID
+func (s *SmartContract) querySensorReadingsWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {ID, PAGESIZE, BOOKMARK}")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(readingIndex, []string{args[0]}, pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructRecordPage(APIstub, resultsIterator, metadata, func(id string, value []byte) ([]byte, error) {
+		return value, nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ./executeQuery.sh '{"Args":["queryAssetsWithOpenExcursions"]}' supplycc
+func (s *SmartContract) queryAssetsWithOpenExcursions(APIstub shim.ChaincodeStubInterface) sc.Response {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(openExcursionIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	assets := []Asset{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		id, err := assetID(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		asset, err := getAsset(APIstub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if asset != nil {
+			assets = append(assets, *asset)
+		}
+	}
+
+	assetsAsBytes, _ := json.Marshal(assets)
+	return shim.Success(assetsAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryAssetsWithOpenExcursionsWithPagination", "10", ""]}' supplycc
+// Each record is keyed by the asset ID and holds the asset
+func (s *SmartContract) queryAssetsWithOpenExcursionsWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {PAGESIZE, BOOKMARK}")
+	}
+
+	pageSize, err := parsePageSize(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(openExcursionIndex, []string{}, pageSize, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructRecordPage(APIstub, resultsIterator, metadata, func(id string, value []byte) ([]byte, error) {
+		asset, err := getAsset(APIstub, id)
+		if err != nil || asset == nil {
+			return nil, err
+		}
+		return json.Marshal(asset)
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+func (s *SmartContract) queryAllAssets(APIstub shim.ChaincodeStubInterface) sc.Response {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(assetIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		id, err := assetID(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(id)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+
+		buffer.WriteString(string(queryResponse.Value))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- queryAllAssets:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+func (s *SmartContract) queryAllAssetsWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {PAGESIZE, BOOKMARK}")
+	}
+
+	pageSize, err := parsePageSize(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(assetIndex, []string{}, pageSize, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructQueryPage(APIstub, resultsIterator, metadata, true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+func (s *SmartContract) queryAssets(APIstub shim.ChaincodeStubInterface) sc.Response {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(assetIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		id, err := assetID(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(id)
+		buffer.WriteString("\"")
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+	fmt.Printf("- queryAllAssets:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ./executeQuery.sh '{"Args":["queryAssetsWithPagination", "10", ""]}' supplycc
+// Like queryAssets, the page only holds the asset IDs
+func (s *SmartContract) queryAssetsWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 {PAGESIZE, BOOKMARK}")
+	}
+
+	pageSize, err := parsePageSize(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(assetIndex, []string{}, pageSize, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructQueryPage(APIstub, resultsIterator, metadata, false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+func (s *SmartContract) queryByAsset(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an Asset")
+	}
+
+	asset, err := getAsset(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Invalid key. Expecting an Asset")
+	}
+
+	assetAsBytes, _ := json.Marshal(asset)
+	return shim.Success(assetAsBytes)
+}
+
+// ./executeQuery.sh '{"Args":["queryRouteMetrics", "ASSET1"]}' supplycc
+// Returns the distance, time and speed of each leg between consecutive transits of the
+// asset and their totals, flagging legs faster than maxPlausibleSpeedKmh. A leg whose transits
+// cannot be read is flagged and left out of the totals rather than failing the query
+func (s *SmartContract) queryRouteMetrics(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 {ID}")
+	}
+
+	asset, err := getAsset(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Invalid key. Expecting an Asset")
+	}
+
+	metrics := RouteMetrics{ID: args[0], Legs: []RouteLeg{}}
+	for i := 1; i < len(asset.Transits); i++ {
+		leg, err := routeLeg(asset.Transits[i-1], asset.Transits[i])
+		if err != nil {
+			metrics.Legs = append(metrics.Legs, RouteLeg{From: leg.From, To: leg.To, Implausible: true, Reason: err.Error()})
+			metrics.Implausible = true
+			continue
+		}
+		metrics.Legs = append(metrics.Legs, leg)
+		metrics.DistanceKm += leg.DistanceKm
+		// a leg going back in time would take its hours off the others
+		if leg.DurationHours > 0 {
+			metrics.DurationHours += leg.DurationHours
+		}
+		metrics.Implausible = metrics.Implausible || leg.Implausible
+	}
+	if metrics.DurationHours > 0 {
+		metrics.AverageSpeedKmh = metrics.DistanceKm / metrics.DurationHours
+	}
+
+	metricsAsBytes, _ := json.Marshal(metrics)
+	return shim.Success(metricsAsBytes)
+}
+
+// Rich query, needs CouchDB as state database
+func (s *SmartContract) queryAssetsByAgent(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an Agent")
+	}
+
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"docType": assetDocType, "agent": args[0]},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(APIstub, string(queryAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// Rich query, needs CouchDB as state database
+func (s *SmartContract) queryAssetsByAgentWithPagination(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 {AGENT, PAGESIZE, BOOKMARK}")
+	}
+
+	if len(args[0]) == 0 {
+		return shim.Error("Empty key. Expecting an Agent")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"docType": assetDocType, "agent": args[0]},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := APIstub.GetQueryResultWithPagination(string(queryAsBytes), pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	queryResults, err := constructQueryPage(APIstub, resultsIterator, metadata, true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := assetID(stub, queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		// IDs are client supplied, so they are escaped
+		idAsBytes, _ := json.Marshal(id)
+		buffer.WriteString("{\"Key\":")
+		buffer.Write(idAsBytes)
+
+		buffer.WriteString(", \"Record\":")
+		buffer.WriteString(string(queryResponse.Value))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return buffer.Bytes(), nil
+}
+
+// parsePageSize validates the PAGESIZE argument of paginated queries
+func parsePageSize(pageSize string) (int32, error) {
+	size, err := strconv.ParseInt(pageSize, 10, 32)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid page size %s. Expecting a positive integer", pageSize)
+	}
+	return int32(size), nil
+}
+
+// constructQueryPage reads a page of results into a QueryPage along with the bookmark of the next page.
+// Without withRecords the page only holds the asset IDs
+func constructQueryPage(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface, metadata *sc.QueryResponseMetadata, withRecords bool) ([]byte, error) {
+	page := QueryPage{Records: []QueryRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		id, err := assetID(stub, queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		record := QueryRecord{Key: id}
+		if withRecords {
+			record.Record = queryResponse.Value
+		}
+		page.Records = append(page.Records, record)
+	}
+
+	if metadata != nil {
+		page.FetchedRecordsCount = metadata.FetchedRecordsCount
+		page.Bookmark = metadata.Bookmark
+	}
+
+	return json.Marshal(page)
+}
+
+// constructRecordPage reads a page of an index whose keys start with the asset ID into a QueryPage.
+// Each record is keyed by the asset ID and holds what record makes of the stored value, those it
+// turns into nil are left out. FetchedRecordsCount still counts every entry read
+func constructRecordPage(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface, metadata *sc.QueryResponseMetadata, record func(id string, value []byte) ([]byte, error)) ([]byte, error) {
+	page := QueryPage{Records: []QueryRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attributes) == 0 {
+			return nil, fmt.Errorf("Invalid key %q. Expecting an asset ID", queryResponse.Key)
+		}
+		value, err := record(attributes[0], queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			page.Records = append(page.Records, QueryRecord{Key: attributes[0], Record: value})
+		}
+	}
+
+	if metadata != nil {
+		page.FetchedRecordsCount = metadata.FetchedRecordsCount
+		page.Bookmark = metadata.Bookmark
+	}
+
+	return json.Marshal(page)
+}
+
+// routeLeg works out the distance, duration and speed of the journey between two transits.
+// A leg covering some distance in no time at all, or ending before it starts, is implausible
+func routeLeg(from Transit, to Transit) (RouteLeg, error) {
+	leg := RouteLeg{From: from.HaulierReceptor, To: to.HaulierReceptor}
+
+	distance, err := haversine(from, to)
+	if err != nil {
+		return leg, err
+	}
+	leg.Start, err = parseDate(from.Time)
+	if err != nil {
+		return leg, err
+	}
+	leg.End, err = parseDate(to.Time)
+	if err != nil {
+		return leg, err
+	}
+	start, _ := time.Parse(time.RFC3339, leg.Start)
+	end, _ := time.Parse(time.RFC3339, leg.End)
+
+	leg.DistanceKm = distance
+	leg.DurationHours = end.Sub(start).Hours()
+	switch {
+	case leg.DurationHours < 0:
+		leg.Implausible = true
+		leg.Reason = "Ends before it starts"
+	case leg.DurationHours == 0:
+		leg.Implausible = distance > 0
+		if leg.Implausible {
+			leg.Reason = "Covers some distance in no time"
+		}
+	default:
+		leg.SpeedKmh = distance / leg.DurationHours
+		leg.Implausible = leg.SpeedKmh > maxPlausibleSpeedKmh
+		if leg.Implausible {
+			leg.Reason = fmt.Sprintf("Faster than %.0f km/h", maxPlausibleSpeedKmh)
+		}
+	}
+	return leg, nil
+}
+
+// haversine returns the great circle distance in km between the locations of two transits
+func haversine(from Transit, to Transit) (float64, error) {
+	lat1, lon1, err := parseCoordinates(from.LocLatitude, from.LocLongitude)
+	if err != nil {
+		return 0, err
+	}
+	lat2, lon2, err := parseCoordinates(to.LocLatitude, to.LocLongitude)
+	if err != nil {
+		return 0, err
+	}
+
+	radians := math.Pi / 180
+	dLat := (lat2 - lat1) * radians
+	dLon := (lon2 - lon1) * radians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*radians)*math.Cos(lat2*radians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a))), nil
+}
+
+// getAsset returns the asset stored under the asset namespace, or nil if there is none.
+// An asset not yet moved there by migrateAssets is read from its plain legacy key
+func getAsset(stub shim.ChaincodeStubInterface, id string) (*Asset, error) {
+	key, err := stub.CreateCompositeKey(assetIndex, []string{id})
+	if err != nil {
+		return nil, err
+	}
+
+	assetAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset %s: %s", id, err.Error())
+	}
+	if assetAsBytes == nil {
+		assetAsBytes, err = stub.GetState(id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get asset %s: %s", id, err.Error())
+		}
+		if assetAsBytes == nil {
+			return nil, nil
+		}
+	}
+
+	asset := Asset{}
+	if err := json.Unmarshal(assetAsBytes, &asset); err != nil {
+		return nil, err
+	}
+	// legacy assets were stored without their ID
+	asset.ID = id
+	return &asset, nil
+}
+
+// putAsset stores the asset under the asset namespace, removing its legacy key if it
+// still has one
+func putAsset(stub shim.ChaincodeStubInterface, asset *Asset) error {
+	key, err := stub.CreateCompositeKey(assetIndex, []string{asset.ID})
+	if err != nil {
+		return err
+	}
+
+	asset.DocType = assetDocType
+	assetAsBytes, _ := json.Marshal(asset)
+	if err := stub.PutState(key, assetAsBytes); err != nil {
+		return err
+	}
+
+	legacyAsBytes, err := stub.GetState(asset.ID)
+	if err != nil {
+		return fmt.Errorf("Failed to get asset %s: %s", asset.ID, err.Error())
+	}
+	if legacyAsBytes == nil {
+		return nil
+	}
+	return stub.DelState(asset.ID)
+}
+
+// assetID returns the asset ID of a key of the asset namespace
+func assetID(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	_, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return "", err
+	}
+	if len(attributes) != 1 {
+		return "", fmt.Errorf("Invalid asset key %q", key)
+	}
+	return attributes[0], nil
+}
+
+// putReading stores a sensor reading under reading~asset~time~sensor, so a sensor cannot
+// report twice for the same time
+func putReading(stub shim.ChaincodeStubInterface, reading *SensorReading) error {
+	key, err := stub.CreateCompositeKey(readingIndex, []string{reading.AssetID, reading.Time, reading.SensorID})
+	if err != nil {
+		return err
+	}
+
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("Sensor %s already reported for asset %s at %s", reading.SensorID, reading.AssetID, reading.Time)
+	}
+
+	reading.DocType = readingDocType
+	readingAsBytes, _ := json.Marshal(reading)
+	return stub.PutState(key, readingAsBytes)
+}
+
+// checkReading validates a sensor reading and normalizes its time to RFC 3339 UTC
+func checkReading(reading *SensorReading) error {
+	if len(reading.SensorID) == 0 {
+		return fmt.Errorf("Empty sensor ID. Expecting the sensor of every reading")
+	}
+	date, err := parseDate(reading.Time)
+	if err != nil {
+		return err
+	}
+	reading.Time = date
+	if reading.Celsius < -273.15 {
+		return fmt.Errorf("Invalid temperature %g °C from sensor %s", reading.Celsius, reading.SensorID)
+	}
+	if reading.Humidity < 0 || reading.Humidity > 100 {
+		return fmt.Errorf("Invalid humidity %g%% from sensor %s. Expecting a percentage", reading.Humidity, reading.SensorID)
+	}
+	return nil
+}
+
+// getHandover returns the pending handover of an asset, or nil if there is none
+func getHandover(stub shim.ChaincodeStubInterface, id string) (*Handover, error) {
+	key, err := stub.CreateCompositeKey(handoverIndex, []string{id})
+	if err != nil {
+		return nil, err
+	}
+
+	handoverAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get handover of asset %s: %s", id, err.Error())
+	}
+	if handoverAsBytes == nil {
+		return nil, nil
+	}
+
+	handover := Handover{}
+	if err := json.Unmarshal(handoverAsBytes, &handover); err != nil {
+		return nil, err
+	}
+	return &handover, nil
+}
+
+// putHandover stores the pending handover of an asset
+func putHandover(stub shim.ChaincodeStubInterface, handover *Handover) error {
+	key, err := stub.CreateCompositeKey(handoverIndex, []string{handover.AssetID})
+	if err != nil {
+		return err
+	}
+
+	handover.DocType = handoverDocType
+	handoverAsBytes, _ := json.Marshal(handover)
+	return stub.PutState(key, handoverAsBytes)
+}
+
+// deleteHandover removes the pending handover of an asset
+func deleteHandover(stub shim.ChaincodeStubInterface, handover *Handover) error {
+	key, err := stub.CreateCompositeKey(handoverIndex, []string{handover.AssetID})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// checkHaulier fails unless the certificate of the invoking client names the given haulier
+func checkHaulier(stub shim.ChaincodeStubInterface, haulier string) error {
+	value, found, err := cid.GetAttributeValue(stub, haulierAttribute)
+	if err != nil {
+		return fmt.Errorf("Failed to get client identity: %s", err.Error())
+	}
+	if !found || value != haulier {
+		return fmt.Errorf("Permission denied: only haulier %s may do this", haulier)
+	}
+	return nil
+}
+
+// emitHandoverEvent sets the named chaincode event with the handover as payload
+func emitHandoverEvent(stub shim.ChaincodeStubInterface, name string, handover *Handover) error {
+	payload, err := json.Marshal(handover)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, payload)
+}
+
+// emitAssetEvent sets the named chaincode event. Fabric keeps one event per
+// transaction, so it is called once, after the asset has been stored
+func emitAssetEvent(stub shim.ChaincodeStubInterface, name string, event AssetEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, payload)
+}
+
+// txDate is the time the client proposed the transaction at, in RFC 3339 UTC. Handover
+// expiries are checked against it rather than the peer clock, which endorsers disagree on
+func txDate(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+// parseCoordinates parses a latitude and a longitude in decimal degrees and checks their range
+func parseCoordinates(lat string, lon string) (float64, float64, error) {
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil || math.IsNaN(latitude) || latitude < -90 || latitude > 90 {
+		return 0, 0, fmt.Errorf("Invalid latitude %s. Expecting decimal degrees between -90 and 90", lat)
+	}
+	longitude, err := strconv.ParseFloat(lon, 64)
+	if err != nil || math.IsNaN(longitude) || longitude < -180 || longitude > 180 {
+		return 0, 0, fmt.Errorf("Invalid longitude %s. Expecting decimal degrees between -180 and 180", lon)
+	}
+	return latitude, longitude, nil
+}
+
+// parseLocation validates a caller supplied location and normalizes it to the shortest
+// decimal representation of its coordinates
+func parseLocation(lat string, lon string) (string, string, error) {
+	latitude, longitude, err := parseCoordinates(lat, lon)
+	if err != nil {
+		return "", "", err
+	}
+	return strconv.FormatFloat(latitude, 'f', -1, 64), strconv.FormatFloat(longitude, 'f', -1, 64), nil
+}
+
+// parseCelsius parses a temperature in °C
+func parseCelsius(value string) (float64, error) {
+	celsius, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(celsius) || math.IsInf(celsius, 0) || celsius < -273.15 {
+		return 0, fmt.Errorf("Invalid temperature %s. Expecting degrees Celsius", value)
+	}
+	return celsius, nil
+}
+
+// dateLayouts lists the date formats clients may send, dd/mm/yyyy is still
+// accepted from older clients
+var dateLayouts = []string{time.RFC3339, "02/01/2006"}
+
+// Dates of assets, transits and arrivals are stored in RFC 3339 UTC whatever the
+// format they were sent in
+func parseDate(value string) (string, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid date %s. Expecting RFC 3339 or dd/mm/yyyy", value)
 }
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
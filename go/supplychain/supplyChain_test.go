@@ -0,0 +1,674 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// haulierStub answers GetCreator with the identity of a haulier and pages through
+// composite keys, neither of which MockStub does. When now is set, it is the
+// transaction time instead of the wall clock
+type haulierStub struct {
+	*shim.MockStub
+	creator []byte
+	now     time.Time
+}
+
+func (s haulierStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s haulierStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	if s.now.IsZero() {
+		return s.MockStub.GetTxTimestamp()
+	}
+	return &timestamp.Timestamp{Seconds: s.now.Unix()}, nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination walks the sorted keys of the MockStub from the
+// bookmark on. As on a peer, the bookmark of the next page is its first key
+func (s haulierStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *sc.QueryResponseMetadata, error) {
+	prefix, err := s.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	from, to := prefix, prefix+"\U0010FFFF"
+	if bookmark != "" {
+		from = bookmark
+	}
+	metadata := &sc.QueryResponseMetadata{}
+	for element := s.Keys.Front(); element != nil; element = element.Next() {
+		key := element.Value.(string)
+		if key < from || key >= to {
+			continue
+		}
+		if metadata.FetchedRecordsCount == pageSize {
+			metadata.Bookmark = key
+			break
+		}
+		metadata.FetchedRecordsCount++
+	}
+	if metadata.Bookmark != "" {
+		to = metadata.Bookmark
+	}
+	return shim.NewMockStateRangeQueryIterator(s.MockStub, from, to), metadata, nil
+}
+
+// supplyChain runs the chaincode as the client whose serialized identity is in creator,
+// at the time in now if it is set
+type supplyChain struct {
+	SmartContract
+	creator []byte
+	now     time.Time
+}
+
+func (c *supplyChain) Init(stub shim.ChaincodeStubInterface) sc.Response {
+	return c.SmartContract.Init(haulierStub{stub.(*shim.MockStub), c.creator, c.now})
+}
+
+func (c *supplyChain) Invoke(stub shim.ChaincodeStubInterface) sc.Response {
+	return c.SmartContract.Invoke(haulierStub{stub.(*shim.MockStub), c.creator, c.now})
+}
+
+// haulier returns the serialized identity of a client whose certificate carries the haulier
+// attribute with the given name, or no attribute at all if the name is empty
+func haulier(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		fmt.Println("Failed to generate a key", err)
+		t.FailNow()
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name + "@hauliers"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if name != "" {
+		attributes, _ := json.Marshal(map[string]map[string]string{"attrs": {haulierAttribute: name}})
+		template.ExtraExtensions = []pkix.Extension{{Id: []int{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attributes}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		fmt.Println("Failed to create a certificate", err)
+		t.FailNow()
+	}
+	creator, _ := proto.Marshal(&msp.SerializedIdentity{Mspid: "HauliersMSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	return creator
+}
+
+// at parses an RFC 3339 time for the supplyChain clock
+func at(t *testing.T, date string) time.Time {
+	now, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		fmt.Println("Invalid test time", date)
+		t.FailNow()
+	}
+	return now
+}
+
+func newSupplyChain() (*shim.MockStub, *supplyChain) {
+	cc := new(supplyChain)
+	return shim.NewMockStub("supplycc", cc), cc
+}
+
+////////////////// Util Methods //////////////////
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) []byte {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", string(args[0]), "failed", string(res.Message))
+		t.FailNow()
+	}
+	return res.Payload
+}
+
+func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte, message string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.ERROR || !strings.Contains(res.Message, message) {
+		fmt.Println("Invoke", string(args[0]), "did not fail with", message, "but", res.Status, res.Message)
+		t.FailNow()
+	}
+}
+
+func checkQueryArgs(t *testing.T, stub *shim.MockStub, args [][]byte, values ...string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Query", string(args[0]), "failed", string(res.Message))
+		t.FailNow()
+	}
+	for _, v := range values {
+		if !strings.Contains(string(res.Payload), v) {
+			fmt.Println("Query value", string(res.Payload), "was not", v, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+// buyAsset buys 100 units of IBUPROFENO in Madrid, carried by the agent
+func buyAsset(t *testing.T, stub *shim.MockStub, id string, agent string) string {
+	return string(checkInvoke(t, stub, [][]byte{[]byte("buyAsset"), []byte(id), []byte("IBUPROFENO"), []byte("100"), []byte("250"), []byte("01/03/2018"), []byte(agent), []byte("40.4168"), []byte("-3.7038"), []byte("2018-03-01T08:00:00Z"), []byte("")}))
+}
+
+////////////////// Tests //////////////////
+
+func Test_givenSeveralAssetsWhenQueryAssetsWithPaginationThenTheBookmarkFetchesTheNextPage(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	for _, id := range []string{"ASSET3", "ASSET1", "ASSET2"} {
+		buyAsset(t, stub, id, "HAULIER1")
+	}
+
+	var ids []string
+	bookmark := ""
+	for page := 0; page == 0 || bookmark != ""; page++ {
+		res := stub.MockInvoke("1", [][]byte{[]byte("queryAssetsWithPagination"), []byte("2"), []byte(bookmark)})
+		assets := QueryPage{}
+		if res.Status != shim.OK || json.Unmarshal(res.Payload, &assets) != nil || page > 1 {
+			fmt.Println("queryAssetsWithPagination returned", res.Message, string(res.Payload))
+			t.FailNow()
+		}
+		for _, record := range assets.Records {
+			if record.Record != nil {
+				fmt.Println("queryAssetsWithPagination returned the asset", string(record.Record))
+				t.FailNow()
+			}
+			ids = append(ids, record.Key)
+		}
+		bookmark = assets.Bookmark
+	}
+	if strings.Join(ids, ",") != "ASSET1,ASSET2,ASSET3" {
+		fmt.Println("queryAssetsWithPagination paged through", ids)
+		t.FailNow()
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("queryAssetsWithPagination"), []byte("-1"), []byte("")}, "Invalid page size")
+}
+
+func Test_givenNoAssetIDWhenBuyAssetThenAnIDIsAllocatedFromTheTransaction(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+
+	res := stub.MockInvoke("tx7", [][]byte{[]byte("buyAsset"), []byte(""), []byte("IBUPROFENO"), []byte("100"), []byte("250"), []byte("01/03/2018"), []byte("HAULIER1"), []byte("40.4168"), []byte("-3.7038"), []byte("2018-03-01T08:00:00Z"), []byte("")})
+	if res.Status != shim.OK || string(res.Payload) != "ASSETtx7" {
+		fmt.Println("buyAsset allocated", string(res.Payload), res.Message)
+		t.FailNow()
+	}
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSETtx7")}, "\"id\":\"ASSETtx7\"", "\"agent\":\"HAULIER1\"")
+}
+
+func Test_givenAnExistingAssetWhenBuyAssetWithItsIDThenError(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	if buyAsset(t, stub, "ASSET1", "HAULIER1") != "ASSET1" {
+		fmt.Println("buyAsset did not keep the ID ASSET1")
+		t.FailNow()
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("buyAsset"), []byte("ASSET1"), []byte("ASPIRINA"), []byte("5"), []byte("10"), []byte("02/03/2018"), []byte("HAULIER1"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-02T08:00:00Z"), []byte("")}, "Asset ASSET1 already exists")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}, "\"type\":\"IBUPROFENO\"")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("buyAsset"), []byte("ASSET 2"), []byte("ASPIRINA"), []byte("5"), []byte("10"), []byte("02/03/2018"), []byte("HAULIER1"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-02T08:00:00Z"), []byte("")}, "Invalid asset ID")
+}
+
+func Test_givenAClientWhoIsNotTheAgentWhenBuyAssetOrArrivalThenError(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, [][]byte{[]byte("buyAsset"), []byte("ASSET1"), []byte("IBUPROFENO"), []byte("100"), []byte("250"), []byte("01/03/2018"), []byte("HAULIER1"), []byte("40.4168"), []byte("-3.7038"), []byte("2018-03-01T08:00:00Z"), []byte("")}, "only haulier HAULIER1")
+	cc.creator = nil
+	checkInvokeError(t, stub, [][]byte{[]byte("buyAsset"), []byte("ASSET1"), []byte("IBUPROFENO"), []byte("100"), []byte("250"), []byte("01/03/2018"), []byte("HAULIER1"), []byte("40.4168"), []byte("-3.7038"), []byte("2018-03-01T08:00:00Z"), []byte("")}, "Failed to get client identity")
+
+	cc.creator = haulier(t, "HAULIER1")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, [][]byte{[]byte("arrival"), []byte("ASSET1"), []byte("02/03/2018"), []byte("OK")}, "only haulier HAULIER1")
+
+	cc.creator = haulier(t, "HAULIER1")
+	checkInvoke(t, stub, [][]byte{[]byte("arrival"), []byte("ASSET1"), []byte("02/03/2018"), []byte("OK")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}, "\"status\":\"OK\"")
+}
+
+func Test_givenALegacyAssetWhenMigrateAssetsThenItMovesToTheAssetNamespace(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	stub.MockTransactionStart("legacy")
+	stub.PutState("ASSET7", []byte(`{"type":"ASPIRINA","qty":"5","price":"10","datel":"01/03/2018","agent":"HAULIER1","transits":[{"lat":"40.4168","lon":"-3.7038","time":"01/03/2018","haulierreceptor":"HAULIER1"}],"arrival":null}`))
+	stub.MockTransactionEnd("legacy")
+
+	// still reachable, and still taken, under its plain key
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET7")}, "\"id\":\"ASSET7\"", "\"type\":\"ASPIRINA\"")
+	checkInvokeError(t, stub, [][]byte{[]byte("buyAsset"), []byte("ASSET7"), []byte("IBUPROFENO"), []byte("100"), []byte("250"), []byte("01/03/2018"), []byte("HAULIER1"), []byte("40.4168"), []byte("-3.7038"), []byte("2018-03-01T08:00:00Z"), []byte("")}, "already exists")
+
+	migrated := checkInvoke(t, stub, [][]byte{[]byte("migrateAssets"), []byte("ASSET0"), []byte("ASSET999")})
+	if string(migrated) != `["ASSET7"]` {
+		fmt.Println("migrateAssets moved", string(migrated))
+		t.FailNow()
+	}
+	if stub.State["ASSET7"] != nil {
+		fmt.Println("migrateAssets left the legacy key ASSET7 behind")
+		t.FailNow()
+	}
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAssets")}, "\"Key\":\"ASSET7\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET7")}, "\"docType\":\"asset\"", "\"type\":\"ASPIRINA\"")
+
+	// nothing is left to move
+	checkQueryArgs(t, stub, [][]byte{[]byte("migrateAssets"), []byte("ASSET0"), []byte("ASSET999")}, "[]")
+}
+
+// proposeHandover hands the asset over to HAULIER2 in Barcelona at 14:00
+func proposeHandover(t *testing.T, stub *shim.MockStub, id string, expiresAt ...string) {
+	args := [][]byte{[]byte("proposeHandover"), []byte(id), []byte("HAULIER2"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-01T14:00:00Z")}
+	for _, date := range expiresAt {
+		args = append(args, []byte(date))
+	}
+	checkInvoke(t, stub, args)
+}
+
+func Test_givenAProposedHandoverWhenTheReceivingHaulierAcceptsItThenItBecomesTheAgent(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	cc.now = at(t, "2018-03-01T09:00:00Z")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+
+	proposeHandover(t, stub, "ASSET1")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPendingHandovers"), []byte("HAULIER2")}, "\"assetId\":\"ASSET1\"", "\"expiresAt\":\"2018-03-02T09:00:00Z\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}, "\"agent\":\"HAULIER1\"")
+
+	// custody only moves once the receiving haulier accepts
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptHandover"), []byte("ASSET1")}, "only haulier HAULIER2")
+
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvoke(t, stub, [][]byte{[]byte("acceptHandover"), []byte("ASSET1")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}, "\"agent\":\"HAULIER2\"", "\"lat\":\"41.3851\"", "\"haulierreceptor\":\"HAULIER2\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPendingHandovers")}, "[]")
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptHandover"), []byte("ASSET1")}, "has no pending handover")
+}
+
+func Test_givenAClientWhoIsNotTheAgentWhenProposeHandoverThenError(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+	transit := [][]byte{[]byte("ASSET1"), []byte("HAULIER3"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-01T14:00:00Z")}
+
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, append([][]byte{[]byte("proposeHandover")}, transit...), "only haulier HAULIER1")
+	cc.creator = haulier(t, "")
+	checkInvokeError(t, stub, append([][]byte{[]byte("proposeHandover")}, transit...), "only haulier HAULIER1")
+
+	cc.creator = haulier(t, "HAULIER1")
+	checkInvokeError(t, stub, [][]byte{[]byte("proposeHandover"), []byte("ASSET1"), []byte("HAULIER1"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-01T14:00:00Z")}, "Invalid receiving haulier")
+	checkInvokeError(t, stub, [][]byte{[]byte("proposeHandover"), []byte("ASSET9"), []byte("HAULIER2"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-01T14:00:00Z")}, "Failed to get specified Asset")
+
+	// one handover at a time
+	proposeHandover(t, stub, "ASSET1")
+	checkInvokeError(t, stub, append([][]byte{[]byte("proposeHandover")}, transit...), "already has a pending handover to HAULIER2")
+}
+
+func Test_givenAPendingHandoverWhenCancelHandoverThenOnlyTheProposingHaulierMayCancelIt(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	cc.now = at(t, "2018-03-01T09:00:00Z")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+	proposeHandover(t, stub, "ASSET1")
+
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, [][]byte{[]byte("cancelHandover"), []byte("ASSET1")}, "only haulier HAULIER1")
+
+	cc.creator = haulier(t, "HAULIER1")
+	checkInvoke(t, stub, [][]byte{[]byte("cancelHandover"), []byte("ASSET1")})
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPendingHandovers")}, "[]")
+
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptHandover"), []byte("ASSET1")}, "has no pending handover")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}, "\"agent\":\"HAULIER1\"")
+}
+
+func Test_givenAnExpiredHandoverWhenAcceptHandoverThenError(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	cc.now = at(t, "2018-03-01T09:00:00Z")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("proposeHandover"), []byte("ASSET1"), []byte("HAULIER2"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-01T14:00:00Z"), []byte("2018-03-01T08:00:00Z")}, "Invalid expiry")
+	proposeHandover(t, stub, "ASSET1", "2018-03-01T10:00:00Z")
+
+	cc.now = at(t, "2018-03-01T10:00:00Z")
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, [][]byte{[]byte("acceptHandover"), []byte("ASSET1")}, "expired on 2018-03-01T10:00:00Z")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPendingHandovers")}, "[]")
+
+	// an expired handover blocks no new proposal
+	cc.creator = haulier(t, "HAULIER1")
+	proposeHandover(t, stub, "ASSET1", "2018-03-01T10:30:00Z")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryPendingHandovers"), []byte("HAULIER2")}, "\"expiresAt\":\"2018-03-01T10:30:00Z\"")
+
+	// and anyone may clear it
+	cc.now = at(t, "2018-03-01T11:00:00Z")
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvoke(t, stub, [][]byte{[]byte("cancelHandover"), []byte("ASSET1")})
+	checkInvokeError(t, stub, [][]byte{[]byte("cancelHandover"), []byte("ASSET1")}, "has no pending handover")
+}
+
+func Test_givenTwoTransitsWhenHaversineThenTheGreatCircleDistanceIsReturned(t *testing.T) {
+	madrid := Transit{LocLatitude: "40.4168", LocLongitude: "-3.7038"}
+	for _, c := range []struct {
+		to       Transit
+		distance float64
+	}{
+		{Transit{LocLatitude: "41.3851", LocLongitude: "2.1734"}, 505.44},
+		{Transit{LocLatitude: "40.7128", LocLongitude: "-74.0060"}, 5768.00},
+		{madrid, 0},
+	} {
+		distance, err := haversine(madrid, c.to)
+		if err != nil || distance < c.distance-0.01 || distance > c.distance+0.01 {
+			fmt.Println("haversine to", c.to, "was", distance, err, "instead of", c.distance)
+			t.FailNow()
+		}
+	}
+
+	// across the antimeridian one degree of longitude apart
+	distance, _ := haversine(Transit{LocLatitude: "0", LocLongitude: "179.5"}, Transit{LocLatitude: "0", LocLongitude: "-179.5"})
+	if distance < 111.1 || distance > 111.3 {
+		fmt.Println("haversine across the antimeridian was", distance)
+		t.FailNow()
+	}
+
+	if _, err := haversine(madrid, Transit{LocLatitude: "91", LocLongitude: "0"}); err == nil {
+		fmt.Println("haversine accepted a latitude of 91")
+		t.FailNow()
+	}
+}
+
+func Test_givenTransitsWhenRouteLegThenImplausibleLegsAreFlagged(t *testing.T) {
+	madrid := Transit{LocLatitude: "40.4168", LocLongitude: "-3.7038", Time: "2018-03-01T08:00:00Z"}
+	for _, c := range []struct {
+		to          Transit
+		hours       float64
+		implausible bool
+	}{
+		{Transit{LocLatitude: "41.3851", LocLongitude: "2.1734", Time: "2018-03-01T14:00:00Z"}, 6, false},
+		{Transit{LocLatitude: "40.7128", LocLongitude: "-74.0060", Time: "2018-03-01T09:00:00Z"}, 1, true},
+		{Transit{LocLatitude: "41.3851", LocLongitude: "2.1734", Time: "2018-03-01T08:00:00Z"}, 0, true},
+		{Transit{LocLatitude: "40.4168", LocLongitude: "-3.7038", Time: "2018-03-01T08:00:00Z"}, 0, false},
+		{Transit{LocLatitude: "40.4168", LocLongitude: "-3.7038", Time: "2018-03-01T07:00:00Z"}, -1, true},
+	} {
+		leg, err := routeLeg(madrid, c.to)
+		if err != nil || leg.DurationHours != c.hours || leg.Implausible != c.implausible {
+			fmt.Println("routeLeg to", c.to, "was", leg, err)
+			t.FailNow()
+		}
+	}
+
+	// times of older transits are still in dd/mm/yyyy
+	leg, err := routeLeg(Transit{LocLatitude: "40.4168", LocLongitude: "-3.7038", Time: "01/03/2018"}, Transit{LocLatitude: "41.3851", LocLongitude: "2.1734", Time: "02/03/2018"})
+	if err != nil || leg.Start != "2018-03-01T00:00:00Z" || leg.DurationHours != 24 || leg.SpeedKmh < 21 || leg.SpeedKmh > 21.1 {
+		fmt.Println("routeLeg between dd/mm/yyyy transits was", leg, err)
+		t.FailNow()
+	}
+}
+
+func Test_givenAHandedOverAssetWhenQueryRouteMetricsThenTheLegsAreSummedUp(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+	proposeHandover(t, stub, "ASSET1")
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvoke(t, stub, [][]byte{[]byte("acceptHandover"), []byte("ASSET1")})
+
+	metrics := RouteMetrics{}
+	json.Unmarshal(checkInvoke(t, stub, [][]byte{[]byte("queryRouteMetrics"), []byte("ASSET1")}), &metrics)
+	if len(metrics.Legs) != 1 || metrics.Legs[0].From != "HAULIER1" || metrics.Legs[0].To != "HAULIER2" || metrics.DurationHours != 6 || metrics.AverageSpeedKmh < 84.2 || metrics.AverageSpeedKmh > 84.3 || metrics.Implausible {
+		fmt.Println("queryRouteMetrics returned", metrics)
+		t.FailNow()
+	}
+}
+
+func Test_givenALegacyAssetGoingBackInTimeWhenQueryRouteMetricsThenTheLegIsLeftOutOfTheDuration(t *testing.T) {
+	stub, _ := newSupplyChain()
+	stub.MockTransactionStart("legacy")
+	stub.PutState("ASSET7", []byte(`{"type":"ASPIRINA","agent":"HAULIER3","transits":[`+
+		`{"lat":"40.4168","lon":"-3.7038","time":"2018-03-01T08:00:00Z","haulierreceptor":"HAULIER1"},`+
+		`{"lat":"40.4168","lon":"-3.7038","time":"2018-03-01T07:00:00Z","haulierreceptor":"HAULIER2"},`+
+		`{"lat":"41.3851","lon":"2.1734","time":"2018-03-01T13:00:00Z","haulierreceptor":"HAULIER3"}]}`))
+	stub.MockTransactionEnd("legacy")
+
+	metrics := RouteMetrics{}
+	json.Unmarshal(checkInvoke(t, stub, [][]byte{[]byte("queryRouteMetrics"), []byte("ASSET7")}), &metrics)
+	if len(metrics.Legs) != 2 || !metrics.Legs[0].Implausible || metrics.Legs[1].Implausible || metrics.DurationHours != 6 || !metrics.Implausible {
+		fmt.Println("queryRouteMetrics returned", metrics)
+		t.FailNow()
+	}
+}
+
+func Test_givenAnUnreadableTransitWhenQueryRouteMetricsThenItsLegsAreFlaggedAndLeftOut(t *testing.T) {
+	stub, _ := newSupplyChain()
+	stub.MockTransactionStart("legacy")
+	stub.PutState("ASSET8", []byte(`{"type":"ASPIRINA","agent":"HAULIER3","transits":[`+
+		`{"lat":"40.4168","lon":"-3.7038","time":"2018-03-01T08:00:00Z","haulierreceptor":"HAULIER1"},`+
+		`{"lat":"41.3851","lon":"2.1734","time":"2018-03-01T14:00:00Z","haulierreceptor":"HAULIER2"},`+
+		`{"lat":"north","lon":"2.1734","time":"2018-03-01T15:00:00Z","haulierreceptor":"HAULIER3"},`+
+		`{"lat":"41.3851","lon":"2.1734","time":"yesterday","haulierreceptor":"HAULIER3"}]}`))
+	stub.MockTransactionEnd("legacy")
+
+	metrics := RouteMetrics{}
+	json.Unmarshal(checkInvoke(t, stub, [][]byte{[]byte("queryRouteMetrics"), []byte("ASSET8")}), &metrics)
+	if len(metrics.Legs) != 3 || metrics.Legs[0].Implausible || metrics.DurationHours != 6 || !metrics.Implausible {
+		fmt.Println("queryRouteMetrics returned", metrics)
+		t.FailNow()
+	}
+	for _, leg := range metrics.Legs[1:] {
+		if !leg.Implausible || leg.Reason == "" || leg.DistanceKm != 0 || leg.To != "HAULIER3" {
+			fmt.Println("queryRouteMetrics returned the leg", leg)
+			t.FailNow()
+		}
+	}
+}
+
+func Test_givenATransitTimeBeforeTheLastTransitWhenProposeHandoverThenError(t *testing.T) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("proposeHandover"), []byte("ASSET1"), []byte("HAULIER2"), []byte("41.3851"), []byte("2.1734"), []byte("2018-03-01T07:59:59Z")}, "Expecting a time not earlier than 2018-03-01T08:00:00Z")
+	checkInvokeError(t, stub, [][]byte{[]byte("proposeHandover"), []byte("ASSET1"), []byte("HAULIER2"), []byte("41.3851"), []byte("2.1734"), []byte("28/02/2018")}, "Expecting a time not earlier than")
+	checkInvoke(t, stub, [][]byte{[]byte("proposeHandover"), []byte("ASSET1"), []byte("HAULIER2"), []byte("40.4168"), []byte("-3.7038"), []byte("2018-03-01T08:00:00Z")})
+}
+
+// checkLastEvent drains the events of the stub and checks the one set by the latest transaction
+func checkLastEvent(t *testing.T, stub *shim.MockStub, name string, values ...string) {
+	var event *sc.ChaincodeEvent
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		event = <-stub.ChaincodeEventsChannel
+	}
+	if event == nil || event.EventName != name {
+		fmt.Println("Last event was", event, "instead of", name)
+		t.FailNow()
+	}
+	for _, v := range values {
+		if !strings.Contains(string(event.Payload), v) {
+			fmt.Println("Event", name, "value", string(event.Payload), "was not", v, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+// coldAsset buys ASSET1 for HAULIER1 and keeps it between 2 and 8 °C with the tolerance given
+func coldAsset(t *testing.T, tolerance string) (*shim.MockStub, *supplyChain) {
+	stub, cc := newSupplyChain()
+	cc.creator = haulier(t, "HAULIER1")
+	buyAsset(t, stub, "ASSET1", "HAULIER1")
+	checkInvoke(t, stub, [][]byte{[]byte("setTemperatureRange"), []byte("ASSET1"), []byte("2"), []byte("8"), []byte(tolerance)})
+	return stub, cc
+}
+
+// addReadings reports readings of sensor S1 as time=celsius pairs
+func addReadings(t *testing.T, stub *shim.MockStub, readings ...string) {
+	var batch []SensorReading
+	for _, reading := range readings {
+		parts := strings.SplitN(reading, "=", 2)
+		var celsius float64
+		fmt.Sscan(parts[1], &celsius)
+		batch = append(batch, SensorReading{Time: parts[0], Celsius: celsius, Humidity: 60, SensorID: "S1"})
+	}
+	batchAsBytes, _ := json.Marshal(batch)
+	checkInvoke(t, stub, [][]byte{[]byte("addSensorReadings"), []byte("ASSET1"), batchAsBytes})
+}
+
+func Test_givenReadingsOutOfRangeForTheToleranceWhenAddSensorReadingsThenAnExcursionIsOpenedAndClosed(t *testing.T) {
+	stub, _ := coldAsset(t, "30")
+
+	addReadings(t, stub, "2018-03-01T08:00:00Z=5", "2018-03-01T08:10:00Z=9", "2018-03-01T08:30:00Z=10")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}, "\"outOfRange\":{\"start\":\"2018-03-01T08:10:00Z\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAssetsWithOpenExcursions")}, "[]")
+
+	// thirty minutes out of range is an excursion
+	addReadings(t, stub, "2018-03-01T08:40:00Z=11")
+	checkLastEvent(t, stub, EventExcursionOpened, "\"start\":\"2018-03-01T08:10:00Z\"", "\"detected\":\"2018-03-01T08:40:00Z\"", "\"peakCelsius\":11")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAssetsWithOpenExcursions")}, "\"id\":\"ASSET1\"")
+
+	addReadings(t, stub, "2018-03-01T08:45:00Z=-1", "2018-03-01T08:50:00Z=7")
+	checkLastEvent(t, stub, EventExcursionClosed, "\"end\":\"2018-03-01T08:50:00Z\"", "\"peakCelsius\":11")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAssetsWithOpenExcursions")}, "[]")
+
+	// a shorter run is forgotten once back in range
+	addReadings(t, stub, "2018-03-01T09:00:00Z=12", "2018-03-01T09:29:59Z=12", "2018-03-01T09:30:00Z=8")
+	asset := Asset{}
+	json.Unmarshal(checkInvoke(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}), &asset)
+	if len(asset.Excursions) != 1 || asset.OutOfRange != nil || asset.LastReading != "2018-03-01T09:30:00Z" {
+		fmt.Println("Excursions", asset.Excursions, "out of range", asset.OutOfRange, "after", asset.LastReading)
+		t.FailNow()
+	}
+}
+
+func Test_givenNoToleranceWhenAReadingIsOutOfRangeThenItIsAnExcursion(t *testing.T) {
+	stub, _ := coldAsset(t, "0")
+
+	addReadings(t, stub, "2018-03-01T08:00:00Z=8.5")
+	checkLastEvent(t, stub, EventExcursionOpened, "\"start\":\"2018-03-01T08:00:00Z\"", "\"detected\":\"2018-03-01T08:00:00Z\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAssetsWithOpenExcursions")}, "\"id\":\"ASSET1\"")
+}
+
+func Test_givenAnOpenExcursionWhenSetTemperatureRangeThenItIsClosed(t *testing.T) {
+	stub, _ := coldAsset(t, "0")
+	addReadings(t, stub, "2018-03-01T08:00:00Z=10", "2018-03-01T08:05:00Z=11")
+	checkLastEvent(t, stub, EventExcursionOpened)
+
+	checkInvoke(t, stub, [][]byte{[]byte("setTemperatureRange"), []byte("ASSET1"), []byte("2"), []byte("25"), []byte("0")})
+	checkLastEvent(t, stub, EventExcursionClosed, "\"end\":\"2018-03-01T08:05:00Z\"")
+	checkQueryArgs(t, stub, [][]byte{[]byte("queryAssetsWithOpenExcursions")}, "[]")
+
+	// the new range starts afresh
+	addReadings(t, stub, "2018-03-01T08:10:00Z=12")
+	asset := Asset{}
+	json.Unmarshal(checkInvoke(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}), &asset)
+	if len(asset.Excursions) != 1 || asset.Excursions[0].End != "2018-03-01T08:05:00Z" || asset.OutOfRange != nil {
+		fmt.Println("Excursions", asset.Excursions, "out of range", asset.OutOfRange)
+		t.FailNow()
+	}
+
+	// a run not yet an excursion is dropped as well
+	checkInvoke(t, stub, [][]byte{[]byte("setTemperatureRange"), []byte("ASSET1"), []byte("2"), []byte("8"), []byte("30")})
+	addReadings(t, stub, "2018-03-01T08:20:00Z=12")
+	checkInvoke(t, stub, [][]byte{[]byte("setTemperatureRange"), []byte("ASSET1"), []byte("2"), []byte("8"), []byte("60")})
+	asset = Asset{}
+	json.Unmarshal(checkInvoke(t, stub, [][]byte{[]byte("queryByAsset"), []byte("ASSET1")}), &asset)
+	if asset.OutOfRange != nil {
+		fmt.Println("setTemperatureRange kept the run", asset.OutOfRange)
+		t.FailNow()
+	}
+}
+
+func Test_givenReadingsBeforeTheLastOneWhenAddSensorReadingsThenError(t *testing.T) {
+	stub, cc := coldAsset(t, "30")
+	addReadings(t, stub, "2018-03-01T08:00:00Z=5")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("addSensorReadings"), []byte("ASSET1"), []byte(`[{"time":"2018-03-01T07:00:00Z","celsius":5,"humidity":60,"sensorId":"S1"}]`)}, "Expecting readings after 2018-03-01T08:00:00Z")
+	checkInvokeError(t, stub, [][]byte{[]byte("addSensorReadings"), []byte("ASSET1"), []byte(`[{"time":"2018-03-01T09:00:00Z","celsius":5,"humidity":60,"sensorId":"S1"},{"time":"2018-03-01T09:00:00Z","celsius":6,"humidity":60,"sensorId":"S1"}]`)}, "Sensor S1 reported twice")
+
+	cc.creator = haulier(t, "HAULIER2")
+	checkInvokeError(t, stub, [][]byte{[]byte("addSensorReadings"), []byte("ASSET1"), []byte(`[{"time":"2018-03-01T09:00:00Z","celsius":5,"humidity":60,"sensorId":"S1"}]`)}, "only haulier HAULIER1")
+	checkInvokeError(t, stub, [][]byte{[]byte("setTemperatureRange"), []byte("ASSET1"), []byte("2"), []byte("8"), []byte("30")}, "only haulier HAULIER1")
+}
+
+// pageThrough follows the bookmarks of a paginated query from the first page on, returning every record
+func pageThrough(t *testing.T, stub *shim.MockStub, args ...string) []QueryRecord {
+	var records []QueryRecord
+	bookmark := ""
+	for page := 0; page == 0 || bookmark != ""; page++ {
+		invocation := [][]byte{}
+		for _, arg := range append(args, bookmark) {
+			invocation = append(invocation, []byte(arg))
+		}
+		res := stub.MockInvoke("1", invocation)
+		result := QueryPage{}
+		if res.Status != shim.OK || json.Unmarshal(res.Payload, &result) != nil || page > 10 {
+			fmt.Println(args[0], "returned", res.Message, string(res.Payload))
+			t.FailNow()
+		}
+		records = append(records, result.Records...)
+		bookmark = result.Bookmark
+	}
+	return records
+}
+
+func Test_givenReadingsExcursionsAndHandoversWhenQueriedWithPaginationThenTheBookmarksFetchTheNextPages(t *testing.T) {
+	stub, cc := coldAsset(t, "0")
+	cc.now = at(t, "2018-03-01T09:00:00Z")
+	buyAsset(t, stub, "ASSET2", "HAULIER1")
+	checkInvoke(t, stub, [][]byte{[]byte("setTemperatureRange"), []byte("ASSET2"), []byte("2"), []byte("8"), []byte("0")})
+	addReadings(t, stub, "2018-03-01T08:00:00Z=5", "2018-03-01T08:10:00Z=9", "2018-03-01T08:20:00Z=10")
+	reading, _ := json.Marshal([]SensorReading{{Time: "2018-03-01T08:00:00Z", Celsius: 12, Humidity: 60, SensorID: "S2"}})
+	checkInvoke(t, stub, [][]byte{[]byte("addSensorReadings"), []byte("ASSET2"), reading})
+
+	readings := pageThrough(t, stub, "querySensorReadingsWithPagination", "ASSET1", "2")
+	if len(readings) != 3 || !strings.Contains(string(readings[2].Record), "\"celsius\":10") || readings[0].Key != "ASSET1" {
+		fmt.Println("querySensorReadingsWithPagination paged through", readings)
+		t.FailNow()
+	}
+
+	assets := pageThrough(t, stub, "queryAssetsWithOpenExcursionsWithPagination", "1")
+	if len(assets) != 2 || assets[0].Key != "ASSET1" || assets[1].Key != "ASSET2" || !strings.Contains(string(assets[1].Record), "\"peakCelsius\":12") {
+		fmt.Println("queryAssetsWithOpenExcursionsWithPagination paged through", assets)
+		t.FailNow()
+	}
+
+	proposeHandover(t, stub, "ASSET1")
+	proposeHandover(t, stub, "ASSET2", "2018-03-01T10:00:00Z")
+	handovers := pageThrough(t, stub, "queryPendingHandoversWithPagination", "HAULIER2", "1")
+	if len(handovers) != 2 || !strings.Contains(string(handovers[1].Record), "\"to\":\"HAULIER2\"") {
+		fmt.Println("queryPendingHandoversWithPagination paged through", handovers)
+		t.FailNow()
+	}
+	if len(pageThrough(t, stub, "queryPendingHandoversWithPagination", "HAULIER3", "1")) != 0 {
+		fmt.Println("queryPendingHandoversWithPagination returned handovers to someone else")
+		t.FailNow()
+	}
+
+	// the expired handover is left out
+	cc.now = at(t, "2018-03-01T11:00:00Z")
+	handovers = pageThrough(t, stub, "queryPendingHandoversWithPagination", "1")
+	if len(handovers) != 1 || handovers[0].Key != "ASSET1" {
+		fmt.Println("queryPendingHandoversWithPagination paged through", handovers)
+		t.FailNow()
+	}
+
+	checkInvokeError(t, stub, [][]byte{[]byte("querySensorReadingsWithPagination"), []byte("ASSET1"), []byte("0"), []byte("")}, "Invalid page size")
+}